@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ADX 日志对象可能是压缩过的。gzip、zstd 和分帧的 snappy 都有魔数，以文件头为准；
+// 没有魔数时 Content-Encoding 或扩展名声明为 snappy 的按不分帧的 snappy 块解压，声明为 gzip、zstd 的
+// 说明内容已经被解压过（如 HTTP 客户端自动解压了 Content-Encoding: gzip），按原文读取
+type adxCompression string
+
+const (
+	compressionNone        adxCompression = "none"
+	compressionGzip        adxCompression = "gzip"
+	compressionZstd        adxCompression = "zstd"
+	compressionSnappy      adxCompression = "snappy"       // 分帧格式，可以流式解压
+	compressionSnappyBlock adxCompression = "snappy-block" // 整个对象一个块，需要全部读入内存
+)
+
+// AdxMaxLineBytes 默认单行的最大字节数，超过的行丢弃并按对象报告
+const AdxMaxLineBytes = 4 << 20
+
+var compressionMagic = []struct {
+	format adxCompression
+	magic  []byte
+}{
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compressionSnappy, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// compressionNames Content-Encoding 或扩展名 -> 声明的格式
+var compressionNames = map[string]adxCompression{
+	"gzip":   compressionGzip,
+	"x-gzip": compressionGzip,
+	"gz":     compressionGzip,
+	"zstd":   compressionZstd,
+	"zst":    compressionZstd,
+	"snappy": compressionSnappy,
+	"sz":     compressionSnappy,
+}
+
+// detectCompression 按文件头、Content-Encoding、扩展名判断对象的压缩格式
+func detectCompression(key, contentEncoding string, head []byte) adxCompression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	declared := compressionNames[strings.ToLower(strings.TrimSpace(contentEncoding))]
+	if declared == "" {
+		declared = compressionNames[strings.ToLower(strings.TrimPrefix(path.Ext(key), "."))]
+	}
+	if declared == compressionSnappy {
+		return compressionSnappyBlock
+	}
+	return compressionNone
+}
+
+// decompressAdxObject 返回解压后的内容和使用完后的清理函数
+func decompressAdxObject(body io.Reader, key, contentEncoding string) (io.Reader, func(), adxCompression, error) {
+	buffered := bufio.NewReader(body)
+	head, _ := buffered.Peek(16) // 对象不足 16 字节时返回全部内容，读取错误留给后面处理
+	format := detectCompression(key, contentEncoding, head)
+
+	switch format {
+	case compressionGzip:
+		r, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, format, err
+		}
+		return r, func() { r.Close() }, format, nil
+	case compressionZstd:
+		r, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, format, err
+		}
+		return r, r.Close, format, nil
+	case compressionSnappy:
+		return snappy.NewReader(buffered), func() {}, format, nil
+	case compressionSnappyBlock:
+		data, err := io.ReadAll(buffered)
+		if err != nil {
+			return nil, nil, format, err
+		}
+		decoded, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, nil, format, fmt.Errorf("snappy 解压失败: %w", err)
+		}
+		return bytes.NewReader(decoded), func() {}, format, nil
+	}
+	return buffered, func() {}, format, nil
+}
+
+// readAdxLine 读取一行，长度不受缓冲区限制；超过 max 字节时丢弃这一行的其余部分，返回 oversized。
+// 返回的内容在下一次调用前有效
+func readAdxLine(r *bufio.Reader, max int, buf []byte) (line []byte, oversized bool, err error) {
+	line = buf[:0]
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !oversized {
+			if len(line)+len(chunk) > max {
+				oversized = true
+				line = line[:0]
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, oversized, err
+		}
+	}
+}
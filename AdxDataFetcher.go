@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/md5"
@@ -9,7 +8,7 @@ import (
 	"fmt"
 	"github.com/redis/go-redis/v9"
 	"github.com/tencentyun/cos-go-sdk-v5"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
@@ -35,22 +34,13 @@ const (
 )
 
 var Regions = []Region{RegionDE, RegionSG, RegionUS}
-var RegionEps = map[Region]string{
-	RegionDE: EpDe,
-	RegionSG: EpSg,
-	RegionUS: EpUs,
-}
 
 const (
 	//RedisAddr = "localhost:6379"
-	RedisAddr     = "172.31.22.199:6379"
-	RedisPassword = "123456"
-	//RedisPassword      = ""
+	RedisAddr          = "172.31.22.199:6379"
 	RedisCountGroupKey = "ddj:num:group"
 	RedisInfoKey       = "config:offer:map"
 	RedisMetricKey     = "config:offer:audience"
-	CosSecretId        = "IKIDPXLpynHRBbgQqvf49A0VfUy7xScSx7xT"
-	CpsSecretKey       = "SZLmtf6k33i33i34zarnOgfLilUu1oHY"
 )
 
 const (
@@ -58,65 +48,44 @@ const (
 	VikingAdvertiserId = "33"
 )
 
+const (
+	DDJPort = 8103
+	DDJPath = "/v1/ddj/fetch/ddjData"
+)
+
 var RedisClient *redis.Client
 var CosClients = make(map[Region]*cos.Client)
 var ctx = context.Background()
 
-func InitClients() {
+func InitClients(redisConfig RedisConfig, cosConfig CosConfig) error {
 	// Redis
 	RedisClient = redis.NewClient(&redis.Options{
-		Addr:     RedisAddr,
-		Password: RedisPassword,
-		DB:       0,
+		Addr:     redisConfig.Addr,
+		Password: redisConfig.Password,
+		DB:       redisConfig.DB,
 	})
 
-	// 为每个 region 创建 client（实际可能不同 endpoint）
+	// 每个 region 一个 client，对应各自的 endpoint
 	for _, r := range Regions {
-		u, _ := url.Parse(RegionEps[r])
+		u, err := url.Parse(cosConfig.Endpoints[r])
+		if err != nil {
+			return fmt.Errorf("区域 %s 的 COS 地址无效: %w", r, err)
+		}
 		b := &cos.BaseURL{BucketURL: u}
 		client := cos.NewClient(b, &http.Client{
 			Transport: &cos.AuthorizationTransport{
-				SecretID:  CosSecretId,
-				SecretKey: CpsSecretKey,
+				SecretID:  cosConfig.SecretID,
+				SecretKey: cosConfig.SecretKey,
 			},
 		})
-		CosClients[r] = client // 实际中根据 region 切换 endpoint
+		CosClients[r] = client
 	}
+	return nil
 }
 
-func getLastMinute() (date, hour, minute string) {
-	t := time.Now().Add(-1 * time.Minute) // 上一分钟
-	return t.Format("20060102"), t.Format("15"), t.Format("04")
-}
-
-func listAndDownloadFiles(region Region, date, hour, minute string) ([]string, error) {
-	prefix := fmt.Sprintf("adx_device/request/%s/%s/%s", date, hour, minute)
-
-	client := CosClients[region]
-	opt := &cos.BucketGetOptions{
-		Prefix: prefix,
-	}
-
-	result, _, err := client.Bucket.Get(context.Background(), opt)
-	if err != nil {
-		return nil, err
-	}
-
-	var lines []string
-	for _, item := range result.Contents {
-		resp, err := client.Object.Get(context.Background(), item.Key, nil)
-		if err != nil {
-			log.Printf("下载失败 %s: %v", item.Key, err)
-			continue
-		}
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			lines = append(lines, scanner.Text())
-		}
-		resp.Body.Close()
-	}
-
-	return lines, nil
+// lastMinute 上一分钟的起始时间
+func lastMinute() time.Time {
+	return time.Now().Add(-1 * time.Minute).Truncate(time.Minute)
 }
 
 // 校验 GAID 是否合法
@@ -209,13 +178,13 @@ func loadMetricFromRedis() (map[string]MetricItems, error) {
 		var valueStr string
 		err := json.Unmarshal([]byte(value), &valueStr)
 		if err != nil {
-			log.Printf("解析 Metric1 失败: %v", err)
+			slog.Warn("解析 Metric 失败", "offer_id", key, "error", err)
 			continue
 		}
 		var metricItems []MetricItems
 		err2 := json.Unmarshal([]byte(valueStr), &metricItems)
 		if err2 != nil {
-			log.Printf("解析 Metric2 失败: %v", err2)
+			slog.Warn("解析 Metric 列表失败", "offer_id", key, "error", err2)
 			continue
 		}
 		if len(metricItems) > 0 {
@@ -273,16 +242,21 @@ func loadDemandFromRedis() (AppDemand, CPAppMap, AppOfferSiteDemandMap, OfferSit
 	return appDemand, cpAppMap, appOfferSiteDemandMap, offerSiteDemandMap, nil
 }
 
-func startAutoFetch(bloomManager *HourlyBloomManager, rtaService *RtaService) {
+// startAutoFetch 每分钟从各区域的 watermark 补齐到上一分钟。各分钟按顺序处理，
+// 一次补齐超过一分钟时跳过期间的调度，错过的分钟由下一次补齐
+func startAutoFetch(bloomManager *HourlyBloomManager, rtaService *RtaService, fetch FetchConfig, ddj *DDJSender,
+	checkpoint *FetchCheckpoint) {
 	go func() {
 		now := time.Now().UTC()
 		next := now.Truncate(time.Minute).Add(time.Minute + 10*time.Second)
 		time.Sleep(time.Until(next))
 		ticker := time.NewTicker(time.Minute)
-		go processMinute(bloomManager, rtaService)
 
-		for range ticker.C {
-			go processMinute(bloomManager, rtaService)
+		for {
+			checkpoint.CatchUp(lastMinute(), func(minute time.Time, regions []Region) []Region {
+				return processMinute(bloomManager, rtaService, fetch, ddj, minute, regions, minuteOptions{}).Done
+			})
+			<-ticker.C
 		}
 	}()
 }
@@ -296,24 +270,97 @@ func buildMetricMatcher(metricValue string) (matcher map[string]bool) {
 	return
 }
 
-func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService) {
-	date, hour, minute := getLastMinute()
-	log.Printf("处理 %s %s:%s", date, hour, minute)
+// minuteOptions 手动补数据时可以不写入布隆过滤器、不发送给 DDJ
+type minuteOptions struct {
+	NoBloom bool // 只查询布隆过滤器不写入，这一分钟内的重复用本地集合判断
+	NoDDJ   bool // 只分配不发送
+}
+
+// minuteStats 一分钟的处理统计
+type minuteStats struct {
+	Done       []Region // 拉取完成的区域
+	Objects    int64
+	Lines      int64
+	Invalid    int64 // 无法解码、超长、GAID 或 IP 无效的行
+	Candidates int   // 符合需求、参与去重的数据
+	Duplicates int   // 去重时重复的数据
+	Allocated  int   // 分配给 offerSite 的数据
+	Sent       int   // 成功发送给 DDJ 的数据
+
+	OutsideWindow int // 超出布隆过滤器窗口、无法去重而丢弃的数据，同时计入 Duplicates
+}
+
+// fetchRegionMinute 拉取一个区域在 minute 这一分钟的 ADX 日志，逐条交给 fn，返回是否拉取完成。
+// 列出对象失败或有对象重试后仍下载失败时这一分钟的数据不完整，不算完成，下次调度从这一分钟重试；
+// 内容损坏的对象重试也无法处理，只记录，不阻塞这一分钟
+func fetchRegionMinute(logger *slog.Logger, client *cos.Client, region Region, minute time.Time, fetch FetchConfig,
+	fn func(req AdxRequest) bool) (adxStreamStats, bool) {
+	prefix := adxMinutePrefix(minute.Format("20060102"), minute.Format("15"), minute.Format("04"))
+	fetched, err := streamAdxRequests(context.Background(), logger, client, region, prefix, fetch, fn)
+	if err != nil {
+		logger.Error("拉取失败", "error", err)
+		adxFetchErrors.WithLabelValues(string(region)).Inc()
+		return fetched, false
+	}
+	if fetched.Failed > fetched.Corrupt {
+		logger.Warn("有对象下载失败，这一分钟下次重试", "failed_objects", fetched.Failed, "corrupt_objects", fetched.Corrupt)
+		return fetched, false
+	}
+	if fetched.Corrupt > 0 {
+		logger.Warn("有对象内容损坏，已跳过", "corrupt_objects", fetched.Corrupt)
+	}
+	return fetched, true
+}
+
+// processMinute 处理 regions 在 minute 这一分钟的 ADX 日志：拉取 -> 校验 -> 去重 -> 分配 -> 发送给 DDJ。
+// 没有需求时这一分钟不需要数据，所有区域都算完成
+func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService, fetch FetchConfig, ddj *DDJSender,
+	minute time.Time, regions []Region, opts minuteOptions) (stats minuteStats) {
+	start := time.Now()
+	defer func() { processMinuteDuration.Observe(time.Since(start).Seconds()) }()
+
+	minute = minute.Local()
+	// 每次运行一个 run_id，同一次运行的日志都带上它和处理的分钟
+	logger := slog.With("run_id", generateUUID(), "minute", minute.Format("20060102 15:04"))
+	logger.Info("开始处理", "regions", regions)
 
 	appDemand, cpAppMap, appOfferIdSiteDemandMap, offerSiteDemandMap, err := loadDemandFromRedis()
 	if err != nil {
-		log.Printf("加载需求失败: %v", err)
-		return
+		logger.Error("加载需求失败", "error", err)
+		return stats
 	}
 
 	if len(appDemand) == 0 {
-		log.Printf("没有需求")
-		return
+		logger.Info("没有需求")
+		stats.Done = regions
+		return stats
 	}
 	offerMetricItemMap, err := loadMetricFromRedis()
 	if err != nil {
-		log.Printf("加载 Metric 失败: %v", err)
-		return
+		logger.Error("加载 Metric 失败", "error", err)
+		return stats
+	}
+
+	// 按 minute 而不是当前时间去重：和 minute 之前一个窗口到现在的数据比较，写入 minute 所在的桶，
+	// 补齐和补数时不会重复发送 minute 之后已经处理过的设备。超出窗口的无法去重，按重复丢弃
+	outsideWindow := 0
+	testAndAdd := func(key string) bool {
+		added, err := bloomManager.TestAndAddAt(key, minute)
+		if err != nil {
+			outsideWindow++
+		}
+		return added
+	}
+	if opts.NoBloom {
+		seen := make(map[string]bool)
+		since := minute.Add(-bloomManager.Config().Window.Duration())
+		testAndAdd = func(key string) bool {
+			if seen[key] {
+				return false
+			}
+			seen[key] = true
+			return !bloomManager.ContainsBetween(key, since, time.Now())
+		}
 	}
 
 	// 提前构建metric缓存
@@ -326,38 +373,26 @@ func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService) {
 	appCount := make(map[string]int)         // key为appId value为为去重前的数据量
 	appCountDedup := make(map[string]int)    // key为appId value为重复的数据量
 
-	for _, region := range Regions {
-		lines, err := listAndDownloadFiles(region, date, hour, minute)
-		if err != nil {
-			log.Printf("%s 区域拉取失败: %v", region, err)
-			continue
-		}
-
+	for _, region := range regions {
+		regionLogger := logger.With("region", region)
 		stop := true
-
-		log.Printf("处理 %s %s:%s %d 条数据", region, date, hour, len(lines))
 		invalidDeviceCount := 0
 		invalidIpCount := 0
-		for _, line := range lines {
-			var req AdxRequest
-			if err := json.Unmarshal([]byte(line), &req); err != nil {
-				continue
-			}
-
+		fetched, done := fetchRegionMinute(regionLogger, CosClients[region], region, minute, fetch, func(req AdxRequest) bool {
 			if !isValidGAID(req.DeviceId) {
 				invalidDeviceCount++
-				continue
+				return true
 			}
 
 			if !isValidIPv4(req.Ip) {
 				invalidIpCount++
-				continue
+				return true
 			}
 
 			cpKey := req.CountryCode + ":" + req.Platform
 			appIDs, exists := cpAppMap[cpKey]
 			if !exists {
-				continue
+				return true
 			}
 
 			for appID := range appIDs {
@@ -369,8 +404,7 @@ func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService) {
 				// 构造去重 key: MD5(appID) + ":" + deviceId
 				dedupKey := fmt.Sprintf("%x:%s", md5.Sum([]byte(appID)), req.DeviceId)
 
-				if !bloomManager.Contains(dedupKey) {
-					bloomManager.Add(dedupKey)
+				if testAndAdd(dedupKey) {
 
 					offerSiteMap := appOfferIdSiteDemandMap[appID]
 					for offerSite, offerSiteDemand := range offerSiteMap {
@@ -401,25 +435,42 @@ func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService) {
 				stop = false
 			}
 
-			if stop {
-				break
-			}
+			return !stop
+		})
+		if done {
+			stats.Done = append(stats.Done, region)
 		}
+		stats.Objects += fetched.Objects
+		stats.Lines += fetched.Lines
+		stats.Invalid += fetched.InvalidJSON + fetched.Oversized + int64(invalidDeviceCount+invalidIpCount)
 
-		log.Printf("%d 个无效设备, %d 个无效IP", invalidDeviceCount, invalidIpCount)
+		regionLogger.Info("处理完成", "objects", fetched.Objects, "failed_objects", fetched.Failed, "lines", fetched.Lines,
+			"invalid_json", fetched.InvalidJSON, "oversized", fetched.Oversized,
+			"invalid_device", invalidDeviceCount, "invalid_ip", invalidIpCount)
+		adxInvalid.WithLabelValues(string(region), "gaid").Add(float64(invalidDeviceCount))
+		adxInvalid.WithLabelValues(string(region), "ip").Add(float64(invalidIpCount))
 
 	}
+	stats.OutsideWindow = outsideWindow
+	if outsideWindow > 0 {
+		logger.Warn("这一分钟超出布隆过滤器的窗口，无法去重，按重复丢弃", "keys", outsideWindow)
+	}
 
 	for appID, _ := range appCount {
-		log.Printf("app count %s %d %d %d", appID, appDemand[appID], appCount[appID], appCountDedup[appID])
+		stats.Candidates += appCount[appID]
+		stats.Duplicates += appCountDedup[appID]
+		logger.Info("app 统计", "app_id", appID, "demand_left", appDemand[appID],
+			"candidates", appCount[appID], "duplicates", appCountDedup[appID])
 	}
 
 	// 依次分给各个offerSite
 	for offerSite, requests := range results {
 		parts := strings.Split(offerSite, ":")
 		offerId, siteId := parts[0], parts[1]
+		offerLogger := logger.With("offer_id", offerId, "site_id", siteId)
 
-		log.Printf("分给%s %d %d", offerSite, len(requests), offerSiteDemandMap[offerSite])
+		offerLogger.Info("分配数据", "records", len(requests), "demand", offerSiteDemandMap[offerSite])
+		stats.Allocated += len(requests)
 
 		siteIdInt, _ := strconv.Atoi(siteId)
 		// 转换成OfferUserDataBase
@@ -457,28 +508,26 @@ func processMinute(bloomManager *HourlyBloomManager, rtaService *RtaService) {
 				"datas":   offerUserDataBases,
 				"offerId": offerId,
 			}
-			machinIpds := [...]string{
-				"172.31.17.231",
-				"172.31.24.96",
-				"172.31.22.157",
-				"172.31.25.93",
-				"172.31.21.96",
-				"172.31.16.65",
-				"172.31.17.148",
-				"172.31.20.249",
+			if opts.NoDDJ {
+				offerLogger.Info("不发送到 DDJ", "records", len(offerUserDataBases))
+				continue
 			}
-			machineIp := machinIpds[rand.Intn(len(machinIpds))]
-			machineIp = fmt.Sprintf("http://%s:8103/v1/ddj/fetch/ddjData", machineIp)
-			log.Printf("发送%s, %s, %d条数据到ddj %s", offerId, siteId, len(offerUserDataBases), machineIp)
-			err := sendPostRequest(machineIp, postData)
-			//err := sendPostRequest("http://localhost:8003/v1/ddj/fetch/ddjData", postData)
+			machineUrl := ddj.URL()
+			offerLogger.Info("发送数据到 DDJ", "records", len(offerUserDataBases), "url", machineUrl)
+			err := sendPostRequest(machineUrl, postData)
 			if err != nil {
-				log.Printf("发送%s, %s, %d条数据到ddj失败", offerId, siteId, len(requests))
+				offerLogger.Error("发送数据到 DDJ 失败", "records", len(requests), "url", machineUrl, "error", err)
+				ddjSends.WithLabelValues("error").Inc()
+			} else {
+				ddjSends.WithLabelValues("ok").Inc()
+				ddjRecords.Add(float64(len(offerUserDataBases)))
+				stats.Sent += len(offerUserDataBases)
 			}
 		}
 
 	}
 
+	return stats
 }
 
 func passMetric(reqStr string, metricValue string) bool {
@@ -531,6 +580,21 @@ func updateDemand(offerSite string, demandLeft int) {
 	RedisClient.HSet(ctx, RedisCountGroupKeyNow, offerSite, demandLeft)
 }
 
+// DDJSender 数据发送的目标 DDJ 机器
+type DDJSender struct {
+	config DDJConfig
+}
+
+func NewDDJSender(config DDJConfig) *DDJSender {
+	return &DDJSender{config: config}
+}
+
+// URL 随机选一台机器，返回其接收数据的地址
+func (d *DDJSender) URL() string {
+	machine := d.config.Machines[rand.Intn(len(d.config.Machines))]
+	return fmt.Sprintf("http://%s:%d%s", machine, d.config.Port, d.config.Path)
+}
+
 // 发送 JSON 数据的示例
 func sendPostRequest(url string, data interface{}) error {
 	jsonData, err := json.Marshal(data)
@@ -545,7 +609,6 @@ func sendPostRequest(url string, data interface{}) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("请求失败，状态码: %d", resp.StatusCode)
 		return fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
 	}
 
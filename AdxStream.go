@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tencentyun/cos-go-sdk-v5"
+)
+
+// 流式拉取一个区域一分钟的 ADX 请求：分页列出对象 -> 并发下载 -> 按需解压 -> 逐行解码 -> 调用方的过滤处理。
+// 各阶段之间是有界 channel，调用方处理慢时下载自动暂停，内存占用与这一分钟的数据量无关
+const (
+	AdxDownloadWorkers = 4                      // 默认每个区域同时下载的对象数
+	AdxRetries         = 3                      // 默认每个对象（和每页列表）失败后的重试次数
+	AdxRetryBackoff    = 500 * time.Millisecond // 默认第一次重试前的等待，之后每次翻倍
+
+	adxKeyBuffer     = 16   // 待下载的对象
+	adxRequestBuffer = 1024 // 已解码、待处理的请求
+)
+
+// adxStreamStats 一次拉取的统计
+type adxStreamStats struct {
+	Objects     int64 // 列出的对象数
+	Failed      int64 // 重试后仍下载失败的对象数
+	Corrupt     int64 // 其中内容损坏、对象不存在等重试也不会成功的对象数，不阻塞 watermark
+	Lines       int64 // 读到的行数
+	InvalidJSON int64 // 无法解码的行数
+	Oversized   int64 // 超过 MaxLineBytes 被丢弃的行数
+}
+
+// adxMinutePrefix 一分钟的 ADX 日志在 COS 中的前缀
+func adxMinutePrefix(date, hour, minute string) string {
+	return fmt.Sprintf("adx_device/request/%s/%s/%s", date, hour, minute)
+}
+
+// streamAdxRequests 按到达顺序把 prefix 下所有对象中的请求交给 fn，fn 返回 false 时停止拉取。
+// fn 只在调用方的 goroutine 中执行；列出对象重试后仍失败时返回错误，单个对象重试后仍失败只记录日志
+func streamAdxRequests(ctx context.Context, logger *slog.Logger, client *cos.Client, region Region, prefix string,
+	config FetchConfig, fn func(req AdxRequest) bool) (adxStreamStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stats adxStreamStats
+	keys := make(chan string, adxKeyBuffer)
+	requests := make(chan AdxRequest, adxRequestBuffer)
+
+	// 分页列出对象
+	var listErr error
+	go func() {
+		defer close(keys)
+		listErr = listAdxObjects(ctx, logger, client, prefix, config, func(key string) bool {
+			atomic.AddInt64(&stats.Objects, 1)
+			select {
+			case keys <- key:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	// 并发下载并逐行解码
+	var wg sync.WaitGroup
+	for i := 0; i < max(config.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				err := downloadAdxObject(ctx, logger, client, region, key, config, requests, &stats)
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+				atomic.AddInt64(&stats.Failed, 1)
+				adxDownloadErrors.WithLabelValues(string(region)).Inc()
+				if isPermanent(err) {
+					atomic.AddInt64(&stats.Corrupt, 1)
+					logger.Error("对象无法处理，跳过该对象", "key", key, "error", err)
+				} else {
+					logger.Error("下载失败，跳过该对象", "key", key, "error", err)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(requests)
+	}()
+
+	// 调用方处理；提前停止时取消下载，并排空 channel 让下载的 goroutine 退出
+	stopped := false
+	for req := range requests {
+		if !fn(req) {
+			stopped = true
+			cancel()
+			for range requests {
+			}
+			break
+		}
+	}
+	// requests 关闭时列出对象的 goroutine 已经退出；提前停止导致的取消不是错误
+	if stopped && errors.Is(listErr, context.Canceled) {
+		return stats, nil
+	}
+	return stats, listErr
+}
+
+// listAdxObjects 按 marker 逐页列出 prefix 下的所有对象，每页失败时按退避重试；fn 返回 false 时停止
+func listAdxObjects(ctx context.Context, logger *slog.Logger, client *cos.Client, prefix string, config FetchConfig,
+	fn func(key string) bool) error {
+	opt := &cos.BucketGetOptions{Prefix: prefix}
+	for {
+		var result *cos.BucketGetResult
+		err := retryWithBackoff(ctx, config, func(attempt int) error {
+			var err error
+			result, _, err = client.Bucket.Get(ctx, opt)
+			if err != nil && attempt < config.Retries {
+				logger.Warn("列出对象失败，稍后重试", "marker", opt.Marker, "attempt", attempt+1, "error", err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.Contents {
+			if !fn(item.Key) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return nil
+		}
+		// 没有指定 delimiter 时 COS 可能不返回 NextMarker，此时从本页最后一个对象继续
+		opt.Marker = result.NextMarker
+		if opt.Marker == "" {
+			opt.Marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+}
+
+// retryWithBackoff 执行 fn，失败后等待 RetryBackoff、2*RetryBackoff ... 重试，最多重试 Retries 次；永久错误不重试
+func retryWithBackoff(ctx context.Context, config FetchConfig, fn func(attempt int) error) error {
+	backoff := config.RetryBackoff.Duration()
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= config.Retries || isPermanent(err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// permanentError 重试也不会成功的错误：对象内容损坏（解压失败）、对象不存在或无权访问等
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isPermanent 是否为永久错误
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// adxBodyReader 记录读取原始内容时的错误，用于区分网络错误和解压错误
+type adxBodyReader struct {
+	r   io.Reader
+	err error // 第一个非 EOF 的读取错误
+}
+
+func (b *adxBodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// classify 原始内容读取没有出错时，错误来自解压，内容本身损坏，重试也不会成功
+func (b *adxBodyReader) classify(err error) error {
+	if b.err == nil {
+		return &permanentError{err: err}
+	}
+	return err
+}
+
+// adxObjectStats 一个对象的处理情况，重试时累计
+type adxObjectStats struct {
+	Compression adxCompression
+	Lines       int64 // 已经处理过的行数，重试时跳过
+	InvalidJSON int64
+	Oversized   int64
+}
+
+// downloadAdxObject 下载一个对象并逐行解码发送到 out；中途失败时重新下载，跳过已经发送过的行。
+// 结束时报告这个对象中无法解码和超长的行
+func downloadAdxObject(ctx context.Context, logger *slog.Logger, client *cos.Client, region Region, key string,
+	config FetchConfig, out chan<- AdxRequest, stats *adxStreamStats) error {
+	var object adxObjectStats
+	err := retryWithBackoff(ctx, config, func(attempt int) error {
+		err := decodeAdxObject(ctx, client, region, key, config, out, stats, &object)
+		if err != nil && ctx.Err() == nil && attempt < config.Retries && !isPermanent(err) {
+			logger.Warn("下载失败，稍后重试", "key", key, "lines_done", object.Lines, "attempt", attempt+1, "error", err)
+		}
+		return err
+	})
+
+	attrs := []any{"key", key, "compression", object.Compression, "lines", object.Lines,
+		"invalid_json", object.InvalidJSON, "oversized", object.Oversized}
+	if object.InvalidJSON > 0 || object.Oversized > 0 {
+		logger.Warn("对象中有无法处理的行", attrs...)
+	} else {
+		logger.Debug("对象处理完成", attrs...)
+	}
+	return err
+}
+
+// decodeAdxObject 下载一个对象并按需解压，跳过前 object.Lines 行，之后每解码出一行就发送到 out 并增加 object.Lines。
+// 连接中断时最后不完整的一行不计入，重试时从这一行重新开始。内容损坏和 4xx（429 除外）返回永久错误
+func decodeAdxObject(ctx context.Context, client *cos.Client, region Region, key string, config FetchConfig,
+	out chan<- AdxRequest, stats *adxStreamStats, object *adxObjectStats) error {
+	resp, err := client.Object.Get(ctx, key, nil)
+	if err != nil {
+		if cosErr, ok := cos.IsCOSError(err); ok && cosErr.Response != nil {
+			if code := cosErr.Response.StatusCode; code >= 400 && code < 500 && code != http.StatusTooManyRequests {
+				return &permanentError{err: err}
+			}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw := &adxBodyReader{r: resp.Body}
+	body, release, format, err := decompressAdxObject(raw, key, resp.Header.Get("Content-Encoding"))
+	object.Compression = format
+	if err != nil {
+		return raw.classify(err)
+	}
+	defer release()
+
+	reader := bufio.NewReader(body)
+	skip := object.Lines
+	var buf []byte
+	for {
+		line, oversized, err := readAdxLine(reader, config.MaxLineBytes, buf)
+		buf = line
+		if err != nil && (err != io.EOF || len(line) == 0 && !oversized) {
+			if err == io.EOF {
+				return nil
+			}
+			return raw.classify(err)
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		object.Lines++
+		atomic.AddInt64(&stats.Lines, 1)
+		adxLines.WithLabelValues(string(region)).Inc()
+
+		if oversized {
+			object.Oversized++
+			atomic.AddInt64(&stats.Oversized, 1)
+			adxInvalid.WithLabelValues(string(region), "oversized").Inc()
+			continue
+		}
+		var req AdxRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			object.InvalidJSON++
+			atomic.AddInt64(&stats.InvalidJSON, 1)
+			adxInvalid.WithLabelValues(string(region), "json").Inc()
+			continue
+		}
+		select {
+		case out <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const backfillTimeLayout = "2006-01-02T15:04"
+
+// backfillArgs pando-bloom backfill 的参数
+type backfillArgs struct {
+	From, To   time.Time // 包含两端，本地时间
+	Regions    []Region
+	Options    minuteOptions
+	ConfigArgs []string // 传给 LoadConfig 的参数
+}
+
+// parseBackfillArgs 解析 backfill 的参数，-dry-run 等于同时指定 -no-bloom 和 -no-ddj。
+// 只指定 -no-bloom 时发送的设备不会写入布隆过滤器，之后会被再次发送，需要 -resend 确认
+func parseBackfillArgs(args []string, output io.Writer) (backfillArgs, error) {
+	var parsed backfillArgs
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.SetOutput(output)
+	from := fs.String("from", "", "第一分钟（本地时间），如 2026-10-15T10:00")
+	to := fs.String("to", "", "最后一分钟（包含），默认与 -from 相同")
+	regions := fs.String("regions", "", "逗号分隔的区域，默认全部")
+	dryRun := fs.Bool("dry-run", false, "不写入布隆过滤器，也不发送给 DDJ")
+	noBloom := fs.Bool("no-bloom", false, "只查询布隆过滤器，不写入")
+	noDDJ := fs.Bool("no-ddj", false, "只分配，不发送给 DDJ")
+	resend := fs.Bool("resend", false, "确认 -no-bloom 时仍然发送给 DDJ：发送的设备不写入布隆过滤器，之后会被再次发送")
+	config := fs.String("config", "", "配置文件路径，默认 "+ConfigPath)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: pando-bloom backfill -from 2026-10-15T10:00 [-to 2026-10-15T11:00] [-regions us,sg] [-dry-run]")
+		fmt.Fprintln(fs.Output(), "按分钟重新处理一段时间的 ADX 日志。写入布隆过滤器时需要独占状态文件，先停止服务；"+
+			"-no-bloom 和 -dry-run 只读，可以和服务同时运行。-no-bloom 需要和 -no-ddj 一起使用，除非指定 -resend。"+
+			"写入布隆过滤器时 -from 不能早于去重窗口")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parsed, err
+	}
+	if fs.NArg() > 0 {
+		return parsed, fmt.Errorf("多余的参数: %v", fs.Args())
+	}
+
+	var err error
+	if parsed.From, err = time.ParseInLocation(backfillTimeLayout, *from, time.Local); err != nil {
+		return parsed, fmt.Errorf("-from 无效: %w", err)
+	}
+	parsed.To = parsed.From
+	if *to != "" {
+		if parsed.To, err = time.ParseInLocation(backfillTimeLayout, *to, time.Local); err != nil {
+			return parsed, fmt.Errorf("-to 无效: %w", err)
+		}
+	}
+	if parsed.To.Before(parsed.From) {
+		return parsed, errors.New("-to 不能早于 -from")
+	}
+
+	parsed.Regions = Regions
+	if *regions != "" {
+		parsed.Regions = nil
+		for _, r := range strings.Split(*regions, ",") {
+			region := Region(strings.TrimSpace(r))
+			if !slices.Contains(Regions, region) {
+				return parsed, fmt.Errorf("未知的区域: %q", region)
+			}
+			if !slices.Contains(parsed.Regions, region) {
+				parsed.Regions = append(parsed.Regions, region)
+			}
+		}
+	}
+
+	parsed.Options = minuteOptions{NoBloom: *dryRun || *noBloom, NoDDJ: *dryRun || *noDDJ}
+	if parsed.Options.NoBloom && !parsed.Options.NoDDJ && !*resend {
+		return parsed, errors.New("-no-bloom 时发送给 DDJ 的设备不会写入布隆过滤器，之后会被再次发送；同时指定 -no-ddj，或用 -resend 确认需要重发")
+	}
+	if *config != "" {
+		parsed.ConfigArgs = []string{"-config", *config}
+	}
+	return parsed, nil
+}
+
+// runBackfill pando-bloom backfill：按顺序重新处理一段时间内的每一分钟，打印每分钟的统计
+func runBackfill(args []string) int {
+	parsed, err := parseBackfillArgs(args, os.Stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	config, err := LoadConfig(parsed.ConfigArgs, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := checkBackfillWindow(parsed, config.Bloom.NamespaceConfig(), time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := setupLogger(os.Stderr, config.Log.Level, config.Log.Format); err != nil {
+		fmt.Fprintf(os.Stderr, "初始化日志失败: %v\n", err)
+		return 1
+	}
+	if err := InitClients(config.Redis, config.Cos); err != nil {
+		fmt.Fprintf(os.Stderr, "初始化客户端失败: %v\n", err)
+		return 1
+	}
+	store, err := newSnapshotStore(config.Bloom.SnapshotBackend, filepath.Dir(config.Bloom.StatePath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "创建快照存储失败: %v\n", err)
+		return 1
+	}
+	manager, release, err := openBackfillManager(config.Bloom, store, parsed.Options.NoBloom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开布隆过滤器失败: %v\n", err)
+		return 1
+	}
+	defer release()
+	rtaService := NewRtaService(config.Rta)
+	ddj := NewDDJSender(config.DDJ)
+
+	code := backfillMinutes(parsed, os.Stdout, func(minute time.Time) minuteStats {
+		return processMinute(manager, rtaService, config.Fetch, ddj, minute, parsed.Regions, parsed.Options)
+	})
+	if !parsed.Options.NoBloom {
+		if err := manager.SaveToDisk(); err != nil {
+			fmt.Fprintf(os.Stderr, "保存布隆过滤器失败: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// checkBackfillWindow 写入布隆过滤器时 -from 不能早于窗口内最早的桶：窗口外的分钟无法去重，数据会全部按重复丢弃
+func checkBackfillWindow(args backfillArgs, config NamespaceConfig, now time.Time) error {
+	if args.Options.NoBloom {
+		return nil
+	}
+	bucket := config.Bucket.Duration()
+	oldest := now.Truncate(bucket).Add(-time.Duration(config.NumBuckets()-1) * bucket)
+	if args.From.Before(oldest) {
+		return fmt.Errorf("-from %s 早于布隆过滤器窗口内最早的桶 %s，这些分钟无法去重；只查看统计请用 -dry-run",
+			args.From.Format(backfillTimeLayout), oldest.Local().Format(backfillTimeLayout))
+	}
+	return nil
+}
+
+// openBackfillManager 打开默认命名空间。readOnly 时只读地加载快照和预写日志，不打开预写日志，可以和服务同时运行；
+// 否则先获取状态文件的锁，服务正在运行时返回 ErrStateLocked。release 关闭预写日志并释放锁
+func openBackfillManager(config BloomConfig, store SnapshotStore, readOnly bool) (*HourlyBloomManager, func(), error) {
+	if readOnly {
+		return newReadOnlyManager(config.NamespaceConfig(), config.StatePath, store), func() {}, nil
+	}
+	lock, err := lockState(config.StatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	manager := newHourlyBloomManagerWithStore(config.NamespaceConfig(), config.StatePath, store)
+	return manager, func() {
+		manager.Close()
+		lock.Close()
+	}, nil
+}
+
+// backfillMinutes 从 From 到 To 逐分钟调用 process 并打印统计；有区域没有拉取完成，或处理期间有数据滑出窗口无法去重时返回 1
+func backfillMinutes(args backfillArgs, w io.Writer, process func(minute time.Time) minuteStats) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "分钟\t完成区域\t对象\t行数\t无效\t候选\t重复\t分配\t发送\t窗口外\t")
+
+	var total minuteStats
+	code := 0
+	for minute := args.From; !minute.After(args.To); minute = minute.Add(time.Minute) {
+		stats := process(minute)
+		done := fmt.Sprintf("%d/%d", len(stats.Done), len(args.Regions))
+		if len(stats.Done) < len(args.Regions) {
+			code = 1
+			done += " !"
+		}
+		outside := strconv.Itoa(stats.OutsideWindow)
+		if stats.OutsideWindow > 0 {
+			code = 1
+			outside += " !"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n", minute.Format("2006-01-02 15:04"), done,
+			stats.Objects, stats.Lines, stats.Invalid, stats.Candidates, stats.Duplicates, stats.Allocated, stats.Sent, outside)
+		tw.Flush() // 每处理完一分钟就输出
+
+		total.Objects += stats.Objects
+		total.Lines += stats.Lines
+		total.Invalid += stats.Invalid
+		total.Candidates += stats.Candidates
+		total.Duplicates += stats.Duplicates
+		total.Allocated += stats.Allocated
+		total.Sent += stats.Sent
+		total.OutsideWindow += stats.OutsideWindow
+	}
+	fmt.Fprintf(tw, "合计\t\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+		total.Objects, total.Lines, total.Invalid, total.Candidates, total.Duplicates, total.Allocated, total.Sent, total.OutsideWindow)
+	tw.Flush()
+	return code
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNamespace       = "default"
+	NamespaceCapacity      = 1_000_000 // 按需创建的命名空间默认每个桶 100 万条
+	DefaultShards          = 16        // 默认分片数
+	MaxNamespaces          = 64        // 默认最多的命名空间个数（含默认命名空间）
+	MaxNamespaceMemoryMB   = 16 << 10  // 默认所有命名空间的桶合计最多占用 16GB
+	NamespaceConfigPath    = "./bloom_namespaces.json"
+	namespaceStateFileTmpl = "bloom_state_%s.bin"
+)
+
+var namespaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ErrTooManyNamespaces 命名空间个数已达上限，不再按需创建
+var ErrTooManyNamespaces = errors.New("too many namespaces")
+
+// ErrNamespaceMemory 创建后所有命名空间的桶合计占用的内存超过上限
+var ErrNamespaceMemory = errors.New("namespace memory limit exceeded")
+
+// Duration 以 "10m"、"1h"、"168h" 形式序列化的时间长度
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// NamespaceConfig 命名空间配置：独立的窗口长度、桶粒度、每个桶的容量和误判率
+type NamespaceConfig struct {
+	Name          string   `json:"name"`
+	Window        Duration `json:"window"`   // 窗口长度，如 "24h"、"168h"
+	Bucket        Duration `json:"bucket"`   // 桶粒度，如 "1m"、"10m"、"1h"、"24h"
+	Capacity      uint     `json:"capacity"` // 每个桶的预估容量
+	FalsePositive float64  `json:"falsePositive"`
+	Shards        int      `json:"shards"` // 分片数，每个分片独立加锁
+
+	WALSync WALSyncPolicy `json:"walSync,omitempty"` // 预写日志刷盘策略：always、interval（默认）、none、disabled
+	Exact   bool          `json:"exact,omitempty"`   // 整个窗口的去重用 Redis 精确判断，用于付费转化等不能误判的数据
+	Backend string        `json:"backend,omitempty"` // 桶的过滤器：bloom（默认）、counting（支持删除）
+}
+
+// DefaultNamespaceConfig 默认命名空间，沿用原有的全局参数
+func DefaultNamespaceConfig() NamespaceConfig {
+	return NamespaceConfig{
+		Name:          DefaultNamespace,
+		Window:        Duration(NumHours * BucketDuration),
+		Bucket:        Duration(BucketDuration),
+		Capacity:      HourlyCount,
+		FalsePositive: FalsePositive,
+		Shards:        DefaultShards,
+		WALSync:       WALSyncInterval,
+		Backend:       BackendBloom,
+	}
+}
+
+// NumBuckets 窗口内的桶个数
+func (c NamespaceConfig) NumBuckets() int {
+	return int(c.Window / c.Bucket)
+}
+
+// MemoryMB 窗口内所有桶占用内存的估计值（MB），按 bloom.EstimateParameters 的位数计算，计数布隆过滤器每个计数器半字节。
+// 用浮点数计算，容量很大时不会溢出
+func (c NamespaceConfig) MemoryMB() float64 {
+	perShard := math.Ceil(float64(c.Capacity) / float64(c.NumShards()))
+	bits := math.Ceil(-perShard * math.Log(c.FalsePositive) / (math.Ln2 * math.Ln2))
+	bytes := bits / 8
+	if c.Backend == BackendCounting {
+		bytes = bits / 2
+	}
+	return bytes * float64(c.NumShards()) * float64(c.NumBuckets()) / (1 << 20)
+}
+
+// NumShards 分片数，未配置时为 1
+func (c NamespaceConfig) NumShards() int {
+	if c.Shards <= 0 {
+		return 1
+	}
+	return c.Shards
+}
+
+// withDefaults 补全未填写的字段
+func (c NamespaceConfig) withDefaults() NamespaceConfig {
+	if c.Window == 0 {
+		c.Window = Duration(NumHours * BucketDuration)
+	}
+	if c.Bucket == 0 {
+		c.Bucket = Duration(BucketDuration)
+	}
+	if c.Capacity == 0 {
+		c.Capacity = NamespaceCapacity
+	}
+	if c.FalsePositive == 0 {
+		c.FalsePositive = FalsePositive
+	}
+	if c.Shards == 0 {
+		c.Shards = DefaultShards
+	}
+	if c.WALSync == "" {
+		c.WALSync = WALSyncInterval
+	}
+	if c.Backend == "" {
+		c.Backend = BackendBloom
+	}
+	return c
+}
+
+// Validate 校验命名空间配置
+func (c NamespaceConfig) Validate() error {
+	if !namespaceNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("非法的命名空间名称: %q", c.Name)
+	}
+	if c.Bucket < Duration(time.Second) {
+		return fmt.Errorf("命名空间 %s 桶粒度不能小于 1s", c.Name)
+	}
+	if c.Bucket.Duration()%time.Second != 0 {
+		return fmt.Errorf("命名空间 %s 桶粒度必须是整秒", c.Name)
+	}
+	if Duration(24*time.Hour)%c.Bucket != 0 {
+		return fmt.Errorf("命名空间 %s 桶粒度必须能整除一天", c.Name)
+	}
+	if c.Window < c.Bucket || c.Window%c.Bucket != 0 {
+		return fmt.Errorf("命名空间 %s 窗口长度必须是桶粒度的整数倍", c.Name)
+	}
+	if c.Capacity == 0 {
+		return fmt.Errorf("命名空间 %s 桶容量必须大于 0", c.Name)
+	}
+	if c.FalsePositive <= 0 || c.FalsePositive >= 1 {
+		return fmt.Errorf("命名空间 %s 误判率必须在 (0, 1) 之间", c.Name)
+	}
+	if c.Shards < 1 || c.Shards > 1024 {
+		return fmt.Errorf("命名空间 %s 分片数必须在 [1, 1024] 之间", c.Name)
+	}
+	switch c.Backend {
+	case "", BackendBloom, BackendCounting:
+	default:
+		return fmt.Errorf("命名空间 %s 不支持的过滤器: %q", c.Name, c.Backend)
+	}
+	switch c.WALSync {
+	case "", WALSyncAlways, WALSyncInterval, WALSyncNone, WALSyncDisabled:
+	default:
+		return fmt.Errorf("命名空间 %s 不支持的预写日志刷盘策略: %q", c.Name, c.WALSync)
+	}
+	return nil
+}
+
+// namespaceStatePath 默认命名空间使用 statePath（为空时为 StateFilePath），其余命名空间各自一个文件，与 statePath 在同一目录
+func namespaceStatePath(statePath, name string) string {
+	if statePath == "" {
+		statePath = StateFilePath
+	}
+	if name == DefaultNamespace {
+		return statePath
+	}
+	return filepath.Join(filepath.Dir(statePath), fmt.Sprintf(namespaceStateFileTmpl, name))
+}
+
+// BloomNamespaces 管理所有命名空间的 HourlyBloomManager，按需创建
+type BloomNamespaces struct {
+	managers   map[string]*HourlyBloomManager
+	configPath string
+	statePath  string        // 默认命名空间的状态文件，为空时为 StateFilePath
+	store      SnapshotStore // 为 nil 时快照写在本地状态文件
+	exact      ExactStore    // 精确去重的命名空间使用，为 nil 时全部只用布隆过滤器
+	limit      int           // 最多的命名空间个数，为 0 时不限制
+	maxMemory  float64       // 所有命名空间的桶合计最多占用的内存（MB），为 0 时不限制
+	mtx        chan struct{}
+	createMtx  sync.Mutex // 同一时间只创建一个命名空间；创建时加载快照和回放日志不持有 mtx，不阻塞其他命名空间的读写
+}
+
+// NewBloomNamespaces 按配置创建默认命名空间，并加载之前按需创建的命名空间
+func NewBloomNamespaces(config BloomConfig, store SnapshotStore, exact ExactStore) *BloomNamespaces {
+	n := &BloomNamespaces{
+		managers:   make(map[string]*HourlyBloomManager),
+		configPath: config.NamespacesPath,
+		statePath:  config.StatePath,
+		store:      store,
+		exact:      exact,
+		limit:      config.MaxNamespaces,
+		maxMemory:  float64(config.MaxMemoryMB),
+		mtx:        make(chan struct{}, 1),
+	}
+	n.mtx <- struct{}{}
+
+	n.managers[DefaultNamespace] = n.newManager(config.NamespaceConfig())
+
+	configs, err := n.loadConfigs()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("加载命名空间配置失败", "error", err)
+		}
+		return n
+	}
+	for _, config := range configs {
+		if config.Name == DefaultNamespace {
+			continue
+		}
+		if err := config.Validate(); err != nil {
+			slog.Warn("忽略命名空间配置", "error", err)
+			continue
+		}
+		n.managers[config.Name] = n.newManager(config)
+	}
+	slog.Info("已加载命名空间", "count", len(n.managers))
+	return n
+}
+
+// newManager 创建命名空间的管理器
+func (n *BloomNamespaces) newManager(config NamespaceConfig) *HourlyBloomManager {
+	statePath := namespaceStatePath(n.statePath, config.Name)
+	var m *HourlyBloomManager
+	if n.store == nil {
+		m = newHourlyBloomManager(config, statePath)
+	} else {
+		m = newHourlyBloomManagerWithStore(config, statePath, n.store)
+	}
+	if config.Exact && n.exact != nil {
+		m.exact = newExactTier(n.exact)
+	}
+	return m
+}
+
+// Default 返回默认命名空间
+func (n *BloomNamespaces) Default() *HourlyBloomManager {
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	return n.managers[DefaultNamespace]
+}
+
+// Lookup 获取已存在的命名空间，不会创建
+func (n *BloomNamespaces) Lookup(name string) (*HourlyBloomManager, bool) {
+	if name == "" {
+		name = DefaultNamespace
+	}
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	m, ok := n.managers[name]
+	return m, ok
+}
+
+// all 返回所有命名空间的管理器
+func (n *BloomNamespaces) all() []*HourlyBloomManager {
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	managers := make([]*HourlyBloomManager, 0, len(n.managers))
+	for _, m := range n.managers {
+		managers = append(managers, m)
+	}
+	return managers
+}
+
+// Get 获取命名空间，不存在时按默认参数创建
+func (n *BloomNamespaces) Get(name string) (*HourlyBloomManager, error) {
+	if name == "" {
+		name = DefaultNamespace
+	}
+	return n.Create(NamespaceConfig{Name: name})
+}
+
+// Create 按配置创建命名空间；已存在时直接返回现有的（配置不会被修改）。
+// 命名空间个数达到上限时返回 ErrTooManyNamespaces，避免拼错的名称不断创建新的状态文件；
+// 创建后所有命名空间的桶合计占用的内存超过上限时返回 ErrNamespaceMemory，避免一个请求创建出超大的命名空间
+func (n *BloomNamespaces) Create(config NamespaceConfig) (*HourlyBloomManager, error) {
+	if m, ok := n.Lookup(config.Name); ok {
+		return m, nil
+	}
+
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	n.createMtx.Lock()
+	defer n.createMtx.Unlock()
+
+	// 等待期间可能已经被创建
+	<-n.mtx
+	m, ok := n.managers[config.Name]
+	count := len(n.managers)
+	used := 0.0
+	for _, existing := range n.managers {
+		used += existing.Config().MemoryMB()
+	}
+	n.mtx <- struct{}{}
+	if ok {
+		return m, nil
+	}
+	if n.limit > 0 && count >= n.limit {
+		return nil, fmt.Errorf("%w: 已有 %d 个", ErrTooManyNamespaces, count)
+	}
+	if need := config.MemoryMB(); n.maxMemory > 0 && used+need > n.maxMemory {
+		return nil, fmt.Errorf("%w: 需要 %.0fMB，已使用 %.0fMB，上限 %.0fMB", ErrNamespaceMemory, need, used, n.maxMemory)
+	}
+
+	m = n.newManager(config)
+	m.logger().Info("创建命名空间", "window", config.Window.Duration(), "bucket", config.Bucket.Duration(),
+		"capacity", config.Capacity, "false_positive", config.FalsePositive)
+
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	n.managers[config.Name] = m
+	if err := n.saveConfigs(); err != nil {
+		slog.Error("保存命名空间配置失败", "error", err)
+	}
+	return m, nil
+}
+
+// Configs 返回所有命名空间配置（按名称排序）
+func (n *BloomNamespaces) Configs() []NamespaceConfig {
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	return n.configs()
+}
+
+func (n *BloomNamespaces) configs() []NamespaceConfig {
+	configs := make([]NamespaceConfig, 0, len(n.managers))
+	for _, m := range n.managers {
+		configs = append(configs, m.Config())
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+	return configs
+}
+
+// saveConfigs 持久化命名空间列表，调用方需持有锁
+func (n *BloomNamespaces) saveConfigs() error {
+	data, err := json.MarshalIndent(n.configs(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(n.configPath, data, 0644)
+}
+
+func (n *BloomNamespaces) loadConfigs() ([]NamespaceConfig, error) {
+	data, err := os.ReadFile(n.configPath)
+	if err != nil {
+		return nil, err
+	}
+	var configs []NamespaceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// SaveToDisk 持久化所有命名空间
+func (n *BloomNamespaces) SaveToDisk() error {
+	<-n.mtx
+	err := n.saveConfigs()
+	n.mtx <- struct{}{}
+
+	for _, m := range n.all() {
+		if saveErr := m.SaveToDisk(); saveErr != nil {
+			m.logger().Error("持久化失败", "error", saveErr)
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Close 关闭所有命名空间的预写日志
+func (n *BloomNamespaces) Close() {
+	<-n.mtx
+	defer func() { n.mtx <- struct{}{} }()
+	for _, m := range n.managers {
+		if err := m.Close(); err != nil {
+			m.logger().Error("关闭预写日志失败", "error", err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// bloomShard 一个分片：独立的时间桶环和锁，HourlyBloomManager 按 key 的哈希把数据分到各个分片
+type bloomShard struct {
+	id       int
+	config   *NamespaceConfig
+	capacity uint // 本分片每个桶的容量
+	filters  []*BloomFilterWithTime
+	current  int              // 当前写入的索引
+	history  map[int64][]uint // 一天中的时段 -> 最近几天该时段的桶基数，用于估算新桶容量
+	frozen   []*frozenBuckets // 分片数变化前的桶，只读，所有分片共享同一组
+	mtx      chan struct{}    // 轻量级互斥锁（用带缓冲 channel 实现）
+}
+
+// frozenBuckets 状态文件中分片数与当前配置不同的桶（如旧格式文件只有 1 个分片）。已有的数据无法按新的分片数重新分布，
+// 按原来的分片数只读保留，查询时一并检查，整组过期后丢弃；新的写入只进入按当前配置分片的桶
+type frozenBuckets struct {
+	shards [][]*BloomFilterWithTime // 按原来的分片分组
+	newest int64                    // 最新的桶起始时间
+}
+
+func newFrozenBuckets(shards [][]*BloomFilterWithTime) *frozenBuckets {
+	b := &frozenBuckets{shards: shards}
+	for _, filters := range shards {
+		for _, f := range filters {
+			b.newest = max(b.newest, f.Timestamp)
+		}
+	}
+	return b
+}
+
+// numBuckets 桶的个数
+func (b *frozenBuckets) numBuckets() int {
+	n := 0
+	for _, filters := range b.shards {
+		n += len(filters)
+	}
+	return n
+}
+
+// firstMatch 在 key 原来所在的分片中查找起始时间在 [from, to] 内、最早包含 key 的桶。桶不再写入，不需要加锁
+func (b *frozenBuckets) firstMatch(key string, from, to int64) (int64, bool) {
+	var first int64
+	found := false
+	for _, f := range b.shards[xxhash.Sum64String(key)%uint64(len(b.shards))] {
+		if f.Timestamp < from || f.Timestamp > to || found && f.Timestamp >= first {
+			continue
+		}
+		if f.test(key) {
+			first = f.Timestamp
+			found = true
+		}
+	}
+	return first, found
+}
+
+func newBloomShard(id int, config *NamespaceConfig, capacity uint) *bloomShard {
+	s := &bloomShard{
+		id:       id,
+		config:   config,
+		capacity: capacity,
+		filters:  make([]*BloomFilterWithTime, config.NumBuckets()),
+		current:  -1,
+		history:  make(map[int64][]uint),
+		mtx:      make(chan struct{}, 1),
+	}
+	s.mtx <- struct{}{} // 初始化锁
+	return s
+}
+
+// bucketStart 返回 t 所在桶的起始时间
+func (s *bloomShard) bucketStart(t time.Time) int64 {
+	return t.Truncate(s.config.Bucket.Duration()).Unix()
+}
+
+// bucketSeconds 每个桶的秒数
+func (s *bloomShard) bucketSeconds() int64 {
+	return int64(s.config.Bucket.Duration() / time.Second)
+}
+
+// newFilter 按命名空间的后端和误判率创建一个桶，容量按历史同一时段估算
+func (s *bloomShard) newFilter(ts int64) *BloomFilterWithTime {
+	return newBucketFilter(s.config.Backend, s.sizeFor(ts), s.config.FalsePositive, ts)
+}
+
+// initNew 初始化窗口内所有新的布隆过滤器
+func (s *bloomShard) initNew() {
+	bucketStart := s.bucketStart(time.Now())
+	numBuckets := len(s.filters)
+
+	for i := 0; i < numBuckets; i++ {
+		ts := bucketStart - int64(numBuckets-1-i)*s.bucketSeconds()
+		s.filters[i] = s.newFilter(ts)
+	}
+	s.current = numBuckets - 1 // 最后一个是当前桶
+}
+
+// recoverBuckets 加载后对齐到当前时间：保留窗口内的桶，丢弃过期的桶，为缺失的时间新建空桶。
+// 返回恢复、丢弃和新建的桶起始时间
+func (s *bloomShard) recoverBuckets() (restored, dropped, missing []int64) {
+	currentBucket := s.bucketStart(time.Now())
+	oldestBucket := currentBucket - int64(len(s.filters)-1)*s.bucketSeconds()
+
+	present := make(map[int64]bool, len(s.filters))
+	var completed []*BloomFilterWithTime
+	for i, f := range s.filters {
+		if f == nil {
+			continue
+		}
+		if f.Timestamp < oldestBucket || f.Timestamp > currentBucket || present[f.Timestamp] {
+			dropped = append(dropped, f.Timestamp)
+			completed = append(completed, f)
+			s.filters[i] = nil
+			continue
+		}
+		present[f.Timestamp] = true
+		restored = append(restored, f.Timestamp)
+		if f.Timestamp < currentBucket {
+			completed = append(completed, f)
+		}
+	}
+
+	// 历史基数不持久化，用恢复的已经写完的桶重建，重启后新桶仍按历史估算容量；按时间顺序记录，只保留最近几天
+	slices.SortFunc(completed, func(a, b *BloomFilterWithTime) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+	for _, f := range completed {
+		s.observe(f)
+	}
+
+	for ts := oldestBucket; ts <= currentBucket; ts += s.bucketSeconds() {
+		if !present[ts] {
+			missing = append(missing, ts)
+			s.filters[s.oldestSlot()] = s.newFilter(ts)
+		}
+	}
+
+	s.dropFrozen(oldestBucket)
+	s.current = -1
+	s.currentIndex()
+	return restored, dropped, missing
+}
+
+// dropFrozen 丢弃所有桶都早于 oldestBucket 的只读桶，调用方需持有锁。各分片共享同一组，不修改原来的切片
+func (s *bloomShard) dropFrozen(oldestBucket int64) {
+	if slices.ContainsFunc(s.frozen, func(b *frozenBuckets) bool { return b.newest < oldestBucket }) {
+		s.frozen = slices.DeleteFunc(slices.Clone(s.frozen), func(b *frozenBuckets) bool { return b.newest < oldestBucket })
+	}
+}
+
+// currentIndex 返回当前桶的索引，需要时滚动，调用方需持有锁
+func (s *bloomShard) currentIndex() int {
+	s.current = s.bucketIndex(s.bucketStart(time.Now()))
+	return s.current
+}
+
+// bucketIndex 返回起始时间为 ts 的桶的索引，不存在时覆盖最旧的桶，调用方需持有锁
+func (s *bloomShard) bucketIndex(ts int64) int {
+	if s.current != -1 && s.filters[s.current] != nil && s.filters[s.current].Timestamp == ts {
+		return s.current
+	}
+	for i, f := range s.filters {
+		if f != nil && f.Timestamp == ts {
+			return i
+		}
+	}
+
+	// 滚动到新桶，覆盖最旧的桶；被覆盖的桶已经写完，记录其基数
+	idx := s.oldestSlot()
+	if s.filters[idx] != nil {
+		s.observe(s.filters[idx])
+	}
+	s.filters[idx] = s.newFilter(ts)
+	s.dropFrozen(s.bucketStart(time.Now()) - int64(len(s.filters)-1)*s.bucketSeconds())
+	s.logger().Info("滚动到新桶", "bucket", time.Unix(ts, 0).Format("2006-01-02 15:04"))
+	return idx
+}
+
+// oldestSlot 返回空槽位，没有空槽位时返回时间最早的桶，调用方需持有锁
+func (s *bloomShard) oldestSlot() int {
+	oldest := -1
+	for i, f := range s.filters {
+		if f == nil {
+			return i
+		}
+		if oldest == -1 || f.Timestamp < s.filters[oldest].Timestamp {
+			oldest = i
+		}
+	}
+	return oldest
+}
+
+// add 写入当前桶，调用方需持有锁
+func (s *bloomShard) add(key string) int {
+	idx := s.currentIndex()
+	s.filters[idx].add(key)
+	s.filters[idx].Modified = time.Now().UnixNano()
+	s.maybeGrow(s.filters[idx])
+	return idx
+}
+
+// checkWindow 事件时间早于窗口或晚于当前桶时返回 ErrOutsideWindow
+func (s *bloomShard) checkWindow(t time.Time) error {
+	ts := s.bucketStart(t)
+	currentBucket := s.bucketStart(time.Now())
+	oldestBucket := currentBucket - int64(len(s.filters)-1)*s.bucketSeconds()
+	if ts < oldestBucket || ts > currentBucket {
+		return ErrOutsideWindow
+	}
+	return nil
+}
+
+// addAt 按事件时间写入对应的桶，调用方需持有锁
+func (s *bloomShard) addAt(key string, t time.Time) (int, error) {
+	if err := s.checkWindow(t); err != nil {
+		return -1, err
+	}
+
+	ts := s.bucketStart(t)
+	currentBucket := s.bucketStart(time.Now())
+	idx := s.bucketIndex(ts)
+	if ts == currentBucket {
+		s.current = idx
+	}
+	s.filters[idx].add(key)
+	s.filters[idx].Modified = time.Now().UnixNano()
+	s.maybeGrow(s.filters[idx])
+	return idx, nil
+}
+
+// merge 把远端同一起始时间的桶按位或合并到本地，本地没有时新建，调用方需持有锁。
+// 合并不更新 Modified，合并进来的数据不会再转发给其他实例
+func (s *bloomShard) merge(remote *BloomFilterWithTime) (int, error) {
+	currentBucket := s.bucketStart(time.Now())
+	oldestBucket := currentBucket - int64(len(s.filters)-1)*s.bucketSeconds()
+	if remote.Timestamp < oldestBucket || remote.Timestamp > currentBucket {
+		return 0, ErrOutsideWindow
+	}
+
+	idx := s.bucketIndex(remote.Timestamp)
+	if remote.Timestamp == currentBucket {
+		s.current = idx
+	}
+	return s.filters[idx].merge(remote)
+}
+
+// remove 从窗口内所有包含 key 的桶中删除，返回是否删除了，调用方需持有锁
+func (s *bloomShard) remove(key string) (bool, error) {
+	cutoff := s.bucketStart(time.Now().Add(-s.config.Window.Duration()))
+	removed := false
+	for _, f := range s.filters {
+		if f == nil || f.Timestamp < cutoff {
+			continue
+		}
+		ok, err := f.remove(key)
+		if err != nil {
+			return false, err
+		}
+		removed = removed || ok
+	}
+	return removed, nil
+}
+
+// testAndAdd [since, until] 内未出现过时写入当前桶并返回 true，调用方需持有锁
+func (s *bloomShard) testAndAdd(key string, since, until time.Time) bool {
+	if _, ok := s.firstMatch(key, since, until); ok {
+		return false
+	}
+	s.add(key)
+	return true
+}
+
+// testAndAddAt [t-窗口, 现在] 内未出现过时写入 t 所在的桶并返回 true，调用方需持有锁。
+// 检查到现在而不是 t，t 之后已经写入的 key 不会被再次放行
+func (s *bloomShard) testAndAddAt(key string, t time.Time) (int, bool, error) {
+	if _, ok := s.firstMatch(key, t.Add(-s.config.Window.Duration()), time.Now()); ok {
+		return -1, false, nil
+	}
+	idx, err := s.addAt(key, t)
+	return idx, err == nil, err
+}
+
+// firstMatch 按时间从旧到新查找第一个包含 key 的桶（包括只读的桶），返回桶起始时间，调用方需持有锁
+func (s *bloomShard) firstMatch(key string, since, until time.Time) (int64, bool) {
+	cutoff := s.bucketStart(time.Now().Add(-s.config.Window.Duration()))
+	from := s.bucketStart(since)
+	if from < cutoff {
+		from = cutoff
+	}
+	to := s.bucketStart(until)
+
+	var first int64
+	found := false
+	for i := 0; i < len(s.filters); i++ {
+		f := s.filters[i]
+		if f == nil || f.Timestamp < from || f.Timestamp > to {
+			continue
+		}
+		if found && f.Timestamp >= first {
+			continue
+		}
+		if f.test(key) {
+			first = f.Timestamp
+			found = true
+		}
+	}
+	for _, b := range s.frozen {
+		if ts, ok := b.firstMatch(key, from, to); ok && (!found || ts < first) {
+			first = ts
+			found = true
+		}
+	}
+	return first, found
+}
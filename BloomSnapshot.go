@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// 状态文件格式：
+//
+//	旧格式（无文件头）：24 个桶，每个桶 timestamp(int64) [size(int64) data]
+//	当前格式：magic + version + stateHeader，桶按分片依次写入，每个桶
+//	timestamp [kind(uint8) 扩容层数(uint8) 远端层数(uint8) {m(uint64) k(uint64) size(int64) crc32(uint32) data}...]，
+//	先是本地的层（第一层和扩容层），之后是从对端合并来的层。timestamp 为 0 表示空槽位。
+//	之后是 FrozenGroups 组分片数变化前的只读桶，每组 分片数(uint32)，每个分片 桶数(uint32) 和桶
+//
+// 旧格式可以直接加载，下次保存时写成当前格式
+const (
+	stateMagic   = "PBLM" // 状态文件魔数，旧格式文件没有文件头
+	stateVersion = 1
+
+	maxLayerBits = 1 << 40 // 单层位数上限，只用于防止按 m 计算编码大小时溢出
+)
+
+// stateHeader 状态文件头，记录写入时的桶几何参数
+type stateHeader struct {
+	BucketSeconds int64
+	NumBuckets    int64
+	Capacity      uint64
+	FalsePositive float64
+	Shards        uint32
+	FrozenGroups  uint32 // 只读桶的组数
+}
+
+// errWriter 记录第一个写入错误，之后的写入直接跳过
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) write(data any) {
+	if ew.err == nil {
+		ew.err = binary.Write(ew.w, binary.BigEndian, data)
+	}
+}
+
+func (ew *errWriter) writeBytes(data []byte) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(data)
+	}
+}
+
+// writeLayers 逐层写入 m k size crc32 data
+func (ew *errWriter) writeLayers(layers []encodedLayer) {
+	for _, l := range layers {
+		ew.write(l.m)
+		ew.write(l.k)
+		ew.write(int64(len(l.data)))
+		ew.write(crc32.ChecksumIEEE(l.data))
+		ew.writeBytes(l.data)
+	}
+}
+
+// writeBucket 写入一个桶
+func (ew *errWriter) writeBucket(f *BloomFilterWithTime) {
+	layers, err := f.encodeLayers()
+	if err != nil {
+		ew.err = err
+		return
+	}
+	remote, err := encodeBloomLayers(f.Remote)
+	if err != nil {
+		ew.err = err
+		return
+	}
+	ew.write(f.Timestamp)
+	ew.write(f.kind())
+	ew.write(uint8(len(layers) - 1))
+	ew.write(uint8(len(remote)))
+	ew.writeLayers(layers)
+	ew.writeLayers(remote)
+}
+
+// writeSnapshot 写入文件头、所有分片和还没有过期的只读桶，逐个分片加锁
+func (m *HourlyBloomManager) writeSnapshot(w io.Writer) error {
+	// 只读桶各分片共享，从第一个分片取
+	<-m.shards[0].mtx
+	frozen := m.shards[0].frozen
+	m.shards[0].mtx <- struct{}{}
+
+	ew := &errWriter{w: w}
+	ew.writeBytes([]byte(stateMagic))
+	ew.write(uint32(stateVersion))
+	ew.write(stateHeader{
+		BucketSeconds: int64(m.config.Bucket.Duration() / time.Second),
+		NumBuckets:    int64(m.config.NumBuckets()),
+		Capacity:      uint64(m.config.Capacity),
+		FalsePositive: m.config.FalsePositive,
+		Shards:        uint32(len(m.shards)),
+		FrozenGroups:  uint32(len(frozen)),
+	})
+
+	for _, shard := range m.shards {
+		<-shard.mtx
+		for i := 0; i < len(shard.filters) && ew.err == nil; i++ {
+			if f := shard.filters[i]; f != nil {
+				ew.writeBucket(f)
+			} else {
+				// 写入 nil 标记
+				ew.write(int64(0))
+			}
+		}
+		shard.mtx <- struct{}{}
+	}
+
+	// 只读桶不再写入，不需要加锁
+	cutoff := m.shards[0].bucketStart(time.Now().Add(-m.config.Window.Duration()))
+	for _, b := range frozen {
+		ew.write(uint32(len(b.shards)))
+		for _, filters := range b.shards {
+			live := slices.DeleteFunc(slices.Clone(filters), func(f *BloomFilterWithTime) bool { return f.Timestamp < cutoff })
+			ew.write(uint32(len(live)))
+			for i := 0; i < len(live) && ew.err == nil; i++ {
+				ew.writeBucket(live[i])
+			}
+		}
+	}
+	return ew.err
+}
+
+// SaveToDisk 把快照写入快照存储（默认本地磁盘），旧快照只在新快照完整写入后才被替换。
+// 写快照前先封存预写日志，快照成功后删除封存的日志，之后的写入记在新日志里
+func (m *HourlyBloomManager) SaveToDisk() error {
+	// counting 后端在封存日志和编码期间阻塞写入，先编码到内存，写入存储时不再阻塞
+	var encoded *bytes.Buffer
+	if m.config.Backend == BackendCounting {
+		m.writeMtx.Lock()
+	}
+	sealed := m.sealWAL()
+	if m.config.Backend == BackendCounting {
+		encoded = new(bytes.Buffer)
+		err := m.writeSnapshot(encoded)
+		m.writeMtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.store.Save(m.snapshotName(), func(w io.Writer) error {
+		if encoded != nil {
+			_, err := w.Write(encoded.Bytes())
+			return err
+		}
+		writer := bufio.NewWriterSize(w, 1<<20)
+		if err := m.writeSnapshot(writer); err != nil {
+			return err
+		}
+		return writer.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	removeWALs(sealed)
+
+	m.logger().Info("已持久化", "store", m.store.String(), "snapshot", m.snapshotName())
+	return nil
+}
+
+// sealWAL 封存当前的预写日志，返回快照写入后可以删除的日志；封存失败时不删除任何日志
+func (m *HourlyBloomManager) sealWAL() []string {
+	if m.wal == nil {
+		return nil
+	}
+	sealed, err := m.wal.rotate()
+	if err != nil {
+		m.logger().Warn("封存预写日志失败，本次快照后保留日志", "error", err)
+	}
+	return sealed
+}
+
+// snapshotName 快照在存储中的名称，与本地状态文件名相同
+func (m *HourlyBloomManager) snapshotName() string {
+	return filepath.Base(m.statePath)
+}
+
+// readStateHeader 读取文件头；旧格式文件没有文件头，按版本 0、24 个 1 小时的桶处理
+func readStateHeader(reader *bufio.Reader) (uint32, stateHeader, error) {
+	magic, err := reader.Peek(len(stateMagic))
+	if err != nil {
+		return 0, stateHeader{}, err
+	}
+	if string(magic) != stateMagic {
+		return 0, stateHeader{
+			BucketSeconds: int64(time.Hour / time.Second),
+			NumBuckets:    NumHours,
+			Shards:        1,
+		}, nil
+	}
+
+	reader.Discard(len(stateMagic))
+	var version uint32
+	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+		return 0, stateHeader{}, err
+	}
+
+	if version != stateVersion {
+		return 0, stateHeader{}, fmt.Errorf("不支持的状态文件版本: %d", version)
+	}
+	var header stateHeader
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return 0, stateHeader{}, err
+	}
+	if header.Shards == 0 || header.Shards > 1024 || header.NumBuckets <= 0 {
+		return 0, stateHeader{}, fmt.Errorf("状态文件头非法: %+v", header)
+	}
+	return version, header, nil
+}
+
+// snapshot 从状态文件读出的内容
+type snapshot struct {
+	version uint32
+	header  stateHeader
+	shards  [][]*BloomFilterWithTime // 按分片分组的桶
+	frozen  []*frozenBuckets         // 分片数变化前的只读桶
+	corrupt []string                 // 校验失败被跳过的桶
+}
+
+// numBuckets 读出的有效桶数，包括只读的桶
+func (s *snapshot) numBuckets() int {
+	n := 0
+	for _, filters := range s.shards {
+		n += len(filters)
+	}
+	for _, b := range s.frozen {
+		n += b.numBuckets()
+	}
+	return n
+}
+
+// readSnapshot 读取整个状态文件。每个桶按自身编码的 m/k 还原，与当前配置的容量和误判率无关；
+// 校验失败的桶会被跳过并记录下来；文件被截断时返回已经读到的桶和错误，由调用方决定是否接受
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	reader := bufio.NewReaderSize(r, 1<<20)
+
+	version, header, err := readStateHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := version == 0
+	snap := &snapshot{
+		version: version,
+		header:  header,
+		shards:  make([][]*BloomFilterWithTime, header.Shards),
+	}
+	for shard := range snap.shards {
+		for i := int64(0); i < header.NumBuckets; i++ {
+			f, err := snap.readBucket(reader, legacy, fmt.Sprint(shard))
+			if err != nil {
+				return snap, err
+			}
+			if f != nil {
+				snap.shards[shard] = append(snap.shards[shard], f)
+			}
+		}
+	}
+
+	for group := uint32(0); group < header.FrozenGroups; group++ {
+		var numShards uint32
+		if err := binary.Read(reader, binary.BigEndian, &numShards); err != nil {
+			return snap, err
+		}
+		if numShards == 0 || numShards > 1024 {
+			return snap, fmt.Errorf("只读桶的分片数非法: %d", numShards)
+		}
+		shards := make([][]*BloomFilterWithTime, numShards)
+		for shard := range shards {
+			var n uint32
+			if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+				return snap, err
+			}
+			for i := uint32(0); i < n; i++ {
+				f, err := snap.readBucket(reader, false, fmt.Sprintf("只读%d-%d", group, shard))
+				if err != nil {
+					return snap, err
+				}
+				if f != nil {
+					shards[shard] = append(shards[shard], f)
+				}
+			}
+		}
+		snap.frozen = append(snap.frozen, newFrozenBuckets(shards))
+	}
+	return snap, nil
+}
+
+// readBucket 读取一个桶；空槽位返回 nil，校验失败的桶记录到 corrupt 后返回 nil，读取位置仍然正确
+func (snap *snapshot) readBucket(reader io.Reader, legacy bool, shard string) (*BloomFilterWithTime, error) {
+	var timestamp int64
+	if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return nil, err
+	}
+	if timestamp == 0 {
+		return nil, nil
+	}
+
+	kind := filterKindBloom
+	var extra, remote uint8
+	if !legacy {
+		for _, v := range []any{&kind, &extra, &remote} {
+			if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	layers := make([]encodedLayer, 0, int(extra)+int(remote)+1)
+	valid := true
+	for j := 0; j <= int(extra)+int(remote); j++ {
+		layerKind := kind
+		if j > 0 {
+			layerKind = filterKindBloom // 扩容层和远端层都是布隆过滤器
+		}
+		layer, ok, err := readLayer(reader, legacy, layerKind)
+		if err != nil {
+			return nil, fmt.Errorf("分片 %s: %w", shard, err)
+		}
+		valid = valid && ok
+		layers = append(layers, layer)
+	}
+
+	name := fmt.Sprintf("%s/%s", shard, time.Unix(timestamp, 0).Format("2006-01-02 15:04"))
+	if !valid {
+		snap.corrupt = append(snap.corrupt, name)
+		return nil, nil
+	}
+	f, err := decodeLayers(kind, layers, int(remote), timestamp, !legacy)
+	if err != nil {
+		snap.corrupt = append(snap.corrupt, name)
+		return nil, nil
+	}
+	return f, nil
+}
+
+// readLayer 读取一层 m k size crc32 data，旧格式只有 size data；校验和不一致时返回 false，读取位置仍然正确，可以继续读后面的桶。
+// size 必须等于按 m 算出的编码大小（旧格式的 m 在 data 开头），数据按实际读到的长度分配内存，损坏的大小字段不会导致超大分配
+func readLayer(reader io.Reader, legacy bool, kind uint8) (encodedLayer, bool, error) {
+	var layer encodedLayer
+	if !legacy {
+		if err := binary.Read(reader, binary.BigEndian, &layer.m); err != nil {
+			return layer, false, err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &layer.k); err != nil {
+			return layer, false, err
+		}
+	}
+
+	var size int64
+	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return layer, false, err
+	}
+	var checksum uint32
+	if !legacy {
+		if err := binary.Read(reader, binary.BigEndian, &checksum); err != nil {
+			return layer, false, err
+		}
+	}
+
+	var buf bytes.Buffer
+	m := layer.m
+	if legacy {
+		// 旧格式的 data 是 bloom.BloomFilter.WriteTo 的输出，以 m(uint64) 开头
+		if size < 8 {
+			return layer, false, fmt.Errorf("桶大小非法: %d", size)
+		}
+		if _, err := io.CopyN(&buf, reader, 8); err != nil {
+			return layer, false, err
+		}
+		m = binary.BigEndian.Uint64(buf.Bytes())
+	}
+	expected, err := encodedLayerSize(kind, m)
+	if err != nil {
+		// 后续数据的位置已无法确定
+		return layer, false, err
+	}
+	if size != expected {
+		return layer, false, fmt.Errorf("桶大小非法: %d, m=%d 时应为 %d", size, m, expected)
+	}
+
+	if _, err := io.CopyN(&buf, reader, size-int64(buf.Len())); err != nil {
+		return layer, false, err
+	}
+	layer.data = buf.Bytes()
+	return layer, legacy || crc32.ChecksumIEEE(layer.data) == checksum, nil
+}
+
+// encodedLayerSize 按层的位数（计数器个数）算出编码后的大小，与 GobEncode 的输出一致
+func encodedLayerSize(kind uint8, m uint64) (int64, error) {
+	if m == 0 || m > maxLayerBits {
+		return 0, fmt.Errorf("层位数非法: %d", m)
+	}
+	switch kind {
+	case filterKindBloom:
+		return 24 + 8*int64((m+63)/64), nil // m k 位数 + 位图
+	case filterKindCounting:
+		return 16 + int64((m+1)/2), nil // m k + 每字节两个计数器
+	default:
+		return 0, fmt.Errorf("过滤器类型非法: %d", kind)
+	}
+}
+
+// loadFromDisk 从快照存储加载最新快照，尽量保留能读出的桶
+func (m *HourlyBloomManager) loadFromDisk() error {
+	file, err := m.store.Open(m.snapshotName())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	snap, err := readSnapshot(file)
+	if snap == nil {
+		return err
+	}
+	if snap.version == 0 {
+		m.logger().Info("状态文件为旧格式，下次保存时迁移到当前格式")
+	}
+	if err != nil {
+		m.logger().Warn("状态文件不完整，只恢复已读出的桶", "buckets", snap.numBuckets(), "error", err)
+	}
+	if len(snap.corrupt) > 0 {
+		m.logger().Warn("跳过校验失败的桶（分片/时间）", "count", len(snap.corrupt), "buckets", snap.corrupt)
+	}
+	if snap.numBuckets() == 0 {
+		return fmt.Errorf("状态文件中没有可用的桶")
+	}
+
+	bucketSeconds := int64(m.config.Bucket.Duration() / time.Second)
+	if snap.header.BucketSeconds != bucketSeconds {
+		return fmt.Errorf("桶粒度不一致: 文件 %ds, 配置 %ds", snap.header.BucketSeconds, bucketSeconds)
+	}
+
+	// 布隆过滤器无法转换成计数布隆过滤器，反之亦然
+	kind := backendKind(m.config.Backend)
+	for _, filters := range snap.shards {
+		for _, f := range filters {
+			if f.kind() != kind {
+				return fmt.Errorf("过滤器类型不一致: 文件 %d, 配置 %q", f.kind(), m.config.Backend)
+			}
+		}
+	}
+
+	// 已有数据无法按新的分片数重新分布。布隆过滤器的桶按原来的分片数只读保留到过期，新的写入使用配置的分片数；
+	// 计数布隆过滤器的桶需要支持删除，不能只读，沿用状态文件中的分片数
+	shards, frozen := snap.shards, snap.frozen
+	if int(snap.header.Shards) != len(m.shards) {
+		if kind == filterKindCounting {
+			m.logger().Warn("状态文件分片数与配置不一致，沿用状态文件的分片数", "file_shards", snap.header.Shards, "config_shards", len(m.shards))
+			m.initShards(int(snap.header.Shards))
+		} else {
+			m.logger().Info("状态文件分片数与配置不一致，已有的桶只读保留到过期", "file_shards", snap.header.Shards, "config_shards", len(m.shards))
+			frozen = append(slices.Clone(frozen), newFrozenBuckets(shards))
+			shards = nil
+		}
+	}
+	for _, shard := range m.shards {
+		shard.frozen = frozen
+	}
+
+	loaded := time.Now().UnixNano()
+	for i, filters := range shards {
+		// 按时间排序后只保留最新的若干个桶，窗口变化时也能复用旧数据
+		shard := m.shards[i]
+		for _, f := range filters {
+			f.Modified = loaded // 其他实例可能还没有这些数据，重启后全部参与一次复制
+		}
+		sort.Slice(filters, func(i, j int) bool { return filters[i].Timestamp < filters[j].Timestamp })
+		if len(filters) > len(shard.filters) {
+			filters = filters[len(filters)-len(shard.filters):]
+		}
+		copy(shard.filters, filters)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// startTime 进程启动时间，调用统计从此开始累计
+var startTime = time.Now()
+
+// callCounter 一类调用自启动以来的调用次数、key 数和命中数
+type callCounter struct {
+	calls atomic.Int64
+	keys  atomic.Int64
+	hits  atomic.Int64
+}
+
+func (c *callCounter) record(keys, hits int) {
+	c.calls.Add(1)
+	c.keys.Add(int64(keys))
+	c.hits.Add(int64(hits))
+}
+
+// managerStats 命名空间的调用统计；Contains 的命中为已出现过，Dedup 的命中为重复
+type managerStats struct {
+	add      callCounter
+	contains callCounter
+	dedup    callCounter
+}
+
+// CallStats 一类调用的统计
+type CallStats struct {
+	Calls    int64   `json:"calls"`
+	Keys     int64   `json:"keys"`
+	Hits     int64   `json:"hits"`
+	HitRatio float64 `json:"hitRatio"` // hits / keys
+}
+
+func (c *callCounter) stats() CallStats {
+	s := CallStats{Calls: c.calls.Load(), Keys: c.keys.Load(), Hits: c.hits.Load()}
+	if s.Keys > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.Keys)
+	}
+	return s
+}
+
+// BucketStats 一个时间桶在所有分片上的汇总
+type BucketStats struct {
+	Timestamp              int64   `json:"timestamp"` // 桶起始 Unix 时间
+	Bits                   uint64  `json:"bits"`      // 所有分片、所有层的位数（计数布隆过滤器为计数器个数）
+	Hashes                 uint    `json:"hashes"`    // 第一层的哈希函数个数
+	Layers                 int     `json:"layers"`    // 各分片中最多的层数
+	FillRatio              float64 `json:"fillRatio"`
+	EstimatedElements      uint64  `json:"estimatedElements"`
+	EstimatedFalsePositive float64 `json:"estimatedFalsePositive"` // 各分片估算误判率的平均值，key 均匀分布在各分片
+}
+
+// NamespaceStats GET /stats 返回的单个命名空间统计
+type NamespaceStats struct {
+	Name     string        `json:"name"`
+	Backend  string        `json:"backend"`
+	Shards   int           `json:"shards"`
+	Since    int64         `json:"since"` // 调用统计的起始 Unix 时间
+	Bytes    uint64        `json:"bytes"` // 所有桶占用的内存，包括分片数变化前的只读桶
+	Buckets  []BucketStats `json:"buckets"`
+	Add      CallStats     `json:"add"` // 没有命中的概念，hits 恒为 0
+	Contains CallStats     `json:"contains"`
+	Dedup    CallStats     `json:"dedup"`
+}
+
+// Stats 汇总各桶的饱和度和调用统计，按桶起始时间升序；每个分片只在读取自己的桶时加锁
+func (m *HourlyBloomManager) Stats() NamespaceStats {
+	stats := NamespaceStats{
+		Name:     m.config.Name,
+		Backend:  m.config.Backend,
+		Shards:   len(m.shards),
+		Since:    startTime.Unix(),
+		Add:      m.stats.add.stats(),
+		Contains: m.stats.contains.stats(),
+		Dedup:    m.stats.dedup.stats(),
+	}
+
+	buckets := make(map[int64]*BucketStats)
+	setBits := make(map[int64]uint64)
+	for _, shard := range m.shards {
+		<-shard.mtx
+		for _, f := range shard.filters {
+			if f == nil {
+				continue
+			}
+			b, ok := buckets[f.Timestamp]
+			if !ok {
+				b = &BucketStats{Timestamp: f.Timestamp, Hashes: f.k()}
+				buckets[f.Timestamp] = b
+			}
+			b.Bits += f.bits()
+			b.Layers = max(b.Layers, f.numLayers())
+			b.EstimatedElements += uint64(f.approximatedSize())
+			b.EstimatedFalsePositive += f.fpRate() / float64(len(m.shards))
+			setBits[f.Timestamp] += f.setBits()
+			stats.Bytes += f.sizeBytes()
+		}
+		shard.mtx <- struct{}{}
+	}
+
+	// 分片数变化前的只读桶只计入内存
+	<-m.shards[0].mtx
+	frozen := m.shards[0].frozen
+	m.shards[0].mtx <- struct{}{}
+	for _, b := range frozen {
+		for _, filters := range b.shards {
+			for _, f := range filters {
+				stats.Bytes += f.sizeBytes()
+			}
+		}
+	}
+
+	stats.Buckets = make([]BucketStats, 0, len(buckets))
+	for ts, b := range buckets {
+		if b.Bits > 0 {
+			b.FillRatio = float64(setBits[ts]) / float64(b.Bits)
+		}
+		stats.Buckets = append(stats.Buckets, *b)
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool { return stats.Buckets[i].Timestamp < stats.Buckets[j].Timestamp })
+	return stats
+}
+
+// Stats 所有命名空间的统计，按名称排序
+func (n *BloomNamespaces) Stats() []NamespaceStats {
+	managers := n.all()
+	sort.Slice(managers, func(i, j int) bool { return managers[i].config.Name < managers[j].config.Name })
+	stats := make([]NamespaceStats, len(managers))
+	for i, m := range managers {
+		stats[i] = m.Stats()
+	}
+	return stats
+}
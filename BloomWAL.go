@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// WALSyncPolicy 预写日志的刷盘策略
+type WALSyncPolicy string
+
+const (
+	WALSyncAlways   WALSyncPolicy = "always"   // 每次写入后 fsync，最安全也最慢
+	WALSyncInterval WALSyncPolicy = "interval" // 每隔 WALSyncPeriod 刷新并 fsync 一次
+	WALSyncNone     WALSyncPolicy = "none"     // 每隔 WALSyncPeriod 刷新到操作系统，不主动 fsync
+	WALSyncDisabled WALSyncPolicy = "disabled" // 不写预写日志，只依赖快照
+
+	WALSyncPeriod = time.Second
+	walSuffix     = ".wal"
+	maxWALKeyLen  = 1<<16 - 1
+	walRemove     = -1 // 删除记录的 Timestamp
+)
+
+// walRecord 一条写入记录：key 写入了起始时间为 Timestamp 的桶，Timestamp 为 walRemove 时表示删除了 key
+type walRecord struct {
+	Timestamp int64
+	Key       string
+}
+
+// bloomWAL 两次快照之间写入的 key 的预写日志，进程被 kill -9 或 OOM 时用于补回快照之后的数据。
+// 记录格式：timestamp(int64) keyLen(uint16) key crc32(uint32)，crc32 覆盖前面三个字段
+type bloomWAL struct {
+	path   string
+	policy WALSyncPolicy
+	file   *os.File
+	writer *bufio.Writer
+	mtx    chan struct{}
+	done   chan struct{}
+}
+
+// walPath 状态文件对应的预写日志路径
+func walPath(statePath string) string {
+	return statePath + walSuffix
+}
+
+// openWAL 以追加方式打开预写日志
+func openWAL(path string, policy WALSyncPolicy) (*bloomWAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &bloomWAL{
+		path:   path,
+		policy: policy,
+		file:   file,
+		writer: bufio.NewWriterSize(file, 1<<20),
+		mtx:    make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	w.mtx <- struct{}{}
+
+	if policy != WALSyncAlways {
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// syncLoop 按策略定时刷盘
+func (w *bloomWAL) syncLoop() {
+	ticker := time.NewTicker(WALSyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			<-w.mtx
+			var err error
+			select {
+			case <-w.done: // 等锁期间已经关闭
+			default:
+				err = w.flush(w.policy == WALSyncInterval)
+			}
+			w.mtx <- struct{}{}
+			if err != nil {
+				slog.Error("预写日志刷盘失败", "path", w.path, "error", err)
+			}
+		}
+	}
+}
+
+// flush 把缓冲区写入文件，sync 为 true 时再 fsync，调用方需持有锁
+func (w *bloomWAL) flush(sync bool) error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// append 追加一批记录
+func (w *bloomWAL) append(records []walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	<-w.mtx
+	defer func() { w.mtx <- struct{}{} }()
+
+	buf := make([]byte, 0, 64)
+	for _, r := range records {
+		if len(r.Key) > maxWALKeyLen {
+			return fmt.Errorf("key 过长: %d 字节", len(r.Key))
+		}
+		buf = binary.BigEndian.AppendUint64(buf[:0], uint64(r.Timestamp))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(r.Key)))
+		buf = append(buf, r.Key...)
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+		if _, err := w.writer.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if w.policy == WALSyncAlways {
+		return w.flush(true)
+	}
+	return nil
+}
+
+// rotate 把当前日志封存为带序号的文件并开始写新日志；返回所有已封存的日志，
+// 快照成功后这些日志中的数据都已包含在快照里，可以删除
+func (w *bloomWAL) rotate() ([]string, error) {
+	<-w.mtx
+	defer func() { w.mtx <- struct{}{} }()
+
+	if err := w.flush(true); err != nil {
+		return nil, err
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, err
+	}
+
+	sealed := fmt.Sprintf("%s.%020d", w.path, time.Now().UnixNano())
+	renameErr := os.Rename(w.path, sealed)
+
+	// 无论 rename 是否成功都重新打开，保证之后的写入不会失败
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	w.writer.Reset(file)
+	if renameErr != nil {
+		return nil, renameErr
+	}
+
+	return sealedWALs(w.path)
+}
+
+// close 刷盘并关闭
+func (w *bloomWAL) close() error {
+	<-w.mtx
+	defer func() { w.mtx <- struct{}{} }()
+
+	close(w.done)
+	err := w.flush(true)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sealedWALs 按封存顺序返回已封存的日志
+func sealedWALs(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// removeWALs 删除已经包含在快照中的日志
+func removeWALs(paths []string) {
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			slog.Warn("删除预写日志失败", "path", p, "error", err)
+		}
+	}
+}
+
+// replayWAL 依次回放已封存的日志和当前日志；遇到被截断或校验失败的记录时停止回放该文件。
+// 当前日志之后还会继续追加，truncate 为 true 时截掉损坏的尾部，否则之后追加的记录在下次回放时都读不到
+func replayWAL(path string, truncate bool, fn func(r walRecord)) (int, error) {
+	files, err := sealedWALs(path)
+	if err != nil {
+		return 0, err
+	}
+	files = append(files, path)
+
+	total := 0
+	for _, f := range files {
+		n, valid, err := replayWALFile(f, fn)
+		total += n
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		slog.Warn("预写日志损坏，忽略后续内容", "path", f, "records", n, "valid_bytes", valid, "error", err)
+		if truncate && f == path {
+			if err := os.Truncate(path, valid); err != nil {
+				return total, fmt.Errorf("截断损坏的预写日志失败: %w", err)
+			}
+		}
+	}
+	return total, nil
+}
+
+var errWALChecksum = errors.New("wal record checksum mismatch")
+
+// replayWALFile 回放一个日志文件，返回回放的记录数和有效记录的字节数
+func replayWALFile(path string, fn func(r walRecord)) (int, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1<<20)
+	header := make([]byte, 10)
+	n := 0
+	var valid int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return n, valid, nil
+			}
+			return n, valid, err
+		}
+		keyLen := binary.BigEndian.Uint16(header[8:])
+		rest := make([]byte, int(keyLen)+4)
+		if _, err := io.ReadFull(reader, rest); err != nil {
+			return n, valid, err
+		}
+
+		record := append(header, rest[:keyLen]...)
+		if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(rest[keyLen:]) {
+			return n, valid, errWALChecksum
+		}
+		fn(walRecord{
+			Timestamp: int64(binary.BigEndian.Uint64(header)),
+			Key:       string(rest[:keyLen]),
+		})
+		n++
+		valid += int64(len(header) + len(rest))
+	}
+}
+
+// startWAL 在快照之上回放预写日志，然后打开日志开始记录新的写入
+func (m *HourlyBloomManager) startWAL() {
+	policy := m.config.WALSync
+	if policy == "" {
+		policy = WALSyncInterval
+	}
+	if policy == WALSyncDisabled {
+		return
+	}
+
+	if err := m.replayLog(true); err != nil {
+		// 损坏的尾部没能截掉，继续追加的记录下次也回放不到
+		m.logger().Error("回放预写日志失败，只依赖快照", "error", err)
+		return
+	}
+
+	wal, err := openWAL(walPath(m.statePath), policy)
+	if err != nil {
+		m.logger().Error("打开预写日志失败，只依赖快照", "error", err)
+		return
+	}
+	m.wal = wal
+}
+
+// replayLog 在快照之上回放预写日志；truncate 为 false 时只读取，不修改日志文件
+func (m *HourlyBloomManager) replayLog(truncate bool) error {
+	replayed, expired := 0, 0
+	if _, err := replayWAL(walPath(m.statePath), truncate, func(r walRecord) {
+		shard := m.shard(r.Key)
+		<-shard.mtx
+		var err error
+		if r.Timestamp == walRemove {
+			_, err = shard.remove(r.Key)
+		} else {
+			_, err = shard.addAt(r.Key, time.Unix(r.Timestamp, 0))
+		}
+		shard.mtx <- struct{}{}
+		if err != nil {
+			expired++
+			return
+		}
+		replayed++
+	}); err != nil {
+		return err
+	}
+	if replayed > 0 || expired > 0 {
+		m.logger().Info("已回放预写日志", "replayed", replayed, "expired", expired)
+	}
+	return nil
+}
+
+// logWAL 把写入追加到预写日志；失败只记录日志，不影响已经完成的写入
+func (m *HourlyBloomManager) logWAL(records ...walRecord) {
+	if m.wal == nil || len(records) == 0 {
+		return
+	}
+	if err := m.wal.append(records); err != nil {
+		m.logger().Error("写入预写日志失败", "error", err)
+	}
+}
+
+// Close 刷新并关闭预写日志，退出前调用
+func (m *HourlyBloomManager) Close() error {
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.close()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// 桶的过滤器实现，按命名空间选择
+const (
+	BackendBloom    = "bloom"    // 布隆过滤器，默认
+	BackendCounting = "counting" // 计数布隆过滤器，支持删除，内存是布隆过滤器的 4 倍
+)
+
+// 状态文件和复制增量中记录的过滤器类型
+const (
+	filterKindBloom    uint8 = 0
+	filterKindCounting uint8 = 1
+)
+
+// ErrRemoveUnsupported 布隆过滤器不支持删除
+var ErrRemoveUnsupported = errors.New("namespace backend does not support remove")
+
+// backendKind 后端对应的过滤器类型
+func backendKind(backend string) uint8 {
+	if backend == BackendCounting {
+		return filterKindCounting
+	}
+	return filterKindBloom
+}
+
+// newBucketFilter 按后端创建一个桶
+func newBucketFilter(backend string, capacity uint, fp float64, ts int64) *BloomFilterWithTime {
+	if backend == BackendCounting {
+		return &BloomFilterWithTime{CBF: NewCountingWithEstimates(capacity, fp), Timestamp: ts}
+	}
+	return &BloomFilterWithTime{BF: bloom.NewWithEstimates(capacity, fp), Timestamp: ts}
+}
+
+// decodeBucketFilter 按类型解码一个桶
+func decodeBucketFilter(kind uint8, data []byte, ts int64) (*BloomFilterWithTime, error) {
+	switch kind {
+	case filterKindBloom:
+		bf := &bloom.BloomFilter{}
+		if err := bf.GobDecode(data); err != nil {
+			return nil, err
+		}
+		return &BloomFilterWithTime{BF: bf, Timestamp: ts}, nil
+	case filterKindCounting:
+		cbf := &CountingBloomFilter{}
+		if err := cbf.GobDecode(data); err != nil {
+			return nil, err
+		}
+		return &BloomFilterWithTime{CBF: cbf, Timestamp: ts}, nil
+	default:
+		return nil, fmt.Errorf("未知的过滤器类型: %d", kind)
+	}
+}
+
+func (f *BloomFilterWithTime) kind() uint8 {
+	if f.CBF != nil {
+		return filterKindCounting
+	}
+	return filterKindBloom
+}
+
+func (f *BloomFilterWithTime) add(key string) {
+	if f.CBF != nil {
+		f.CBF.AddString(key)
+		return
+	}
+	f.lastLayer().AddString(key)
+}
+
+func (f *BloomFilterWithTime) test(key string) bool {
+	if f.CBF != nil {
+		return f.CBF.TestString(key)
+	}
+	for _, layer := range f.allLayers() {
+		if layer.TestString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove 删除 key，key 不在桶中时返回 false
+func (f *BloomFilterWithTime) remove(key string) (bool, error) {
+	if f.CBF == nil {
+		return false, ErrRemoveUnsupported
+	}
+	return f.CBF.RemoveString(key), nil
+}
+
+// merge 合并远端同类型的桶，返回因本地层数已满而跳过的层数。布隆过滤器逐层合并到 m/k 相同的层；
+// 没有相同的层时（两边按各自的历史估算了容量）放到 Remote，本地写入和扩容仍然只用本地的层。
+// 计数布隆过滤器不扩容，m/k 必须一致
+func (f *BloomFilterWithTime) merge(remote *BloomFilterWithTime) (int, error) {
+	switch {
+	case f.CBF != nil && remote.CBF != nil:
+		return 0, f.CBF.Merge(remote.CBF)
+	case f.BF != nil && remote.BF != nil:
+		skipped := 0
+		for _, layer := range remote.layers() {
+			ok, err := f.mergeLayer(layer)
+			if err != nil {
+				return skipped, err
+			}
+			if !ok {
+				skipped++
+			}
+		}
+		return skipped, nil
+	default:
+		return 0, fmt.Errorf("过滤器类型不一致: %d 与 %d", f.kind(), remote.kind())
+	}
+}
+
+// mergeLayer 把一层按位或合并到 m/k 相同的本地层或远端层，都没有时追加到 Remote；Remote 已满时跳过并返回 false
+func (f *BloomFilterWithTime) mergeLayer(layer *bloom.BloomFilter) (bool, error) {
+	for _, local := range f.allLayers() {
+		if local.Cap() == layer.Cap() && local.K() == layer.K() {
+			return true, local.Merge(layer)
+		}
+	}
+	if len(f.Remote) >= maxLayers {
+		return false, nil
+	}
+	f.Remote = append(f.Remote, layer.Copy())
+	return true, nil
+}
+
+// encodedLayer 编码后的一层
+type encodedLayer struct {
+	m, k uint64
+	data []byte
+}
+
+// encodeLayers 逐层编码本地的层：第一层是 BF 或 CBF，之后是扩容层
+func (f *BloomFilterWithTime) encodeLayers() ([]encodedLayer, error) {
+	var data []byte
+	var err error
+	if f.CBF != nil {
+		data, err = f.CBF.GobEncode()
+	} else {
+		data, err = f.BF.GobEncode()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := encodeBloomLayers(f.Layers)
+	if err != nil {
+		return nil, err
+	}
+	return append([]encodedLayer{{m: uint64(f.cap()), k: uint64(f.k()), data: data}}, layers...), nil
+}
+
+// encodeBloomLayers 逐层编码布隆过滤器
+func encodeBloomLayers(bfs []*bloom.BloomFilter) ([]encodedLayer, error) {
+	layers := make([]encodedLayer, 0, len(bfs))
+	for _, layer := range bfs {
+		data, err := layer.GobEncode()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, encodedLayer{m: uint64(layer.Cap()), k: uint64(layer.K()), data: data})
+	}
+	return layers, nil
+}
+
+// decodeLayers 按类型解码各层，最后 remote 层放到 Remote；checkMK 为 true 时校验每层记录的 m/k（旧格式状态文件没有记录）
+func decodeLayers(kind uint8, layers []encodedLayer, remote int, ts int64, checkMK bool) (*BloomFilterWithTime, error) {
+	f, err := decodeBucketFilter(kind, layers[0].data, ts)
+	if err != nil {
+		return nil, err
+	}
+	if checkMK && (uint64(f.cap()) != layers[0].m || uint64(f.k()) != layers[0].k) {
+		return nil, errors.New("m/k 不一致")
+	}
+
+	for i, l := range layers[1:] {
+		if kind != filterKindBloom {
+			return nil, errors.New("只有布隆过滤器有扩容层")
+		}
+		bf := &bloom.BloomFilter{}
+		if err := bf.GobDecode(l.data); err != nil {
+			return nil, err
+		}
+		if checkMK && (uint64(bf.Cap()) != l.m || uint64(bf.K()) != l.k) {
+			return nil, errors.New("扩容层 m/k 不一致")
+		}
+		if i >= len(layers)-1-remote {
+			f.Remote = append(f.Remote, bf)
+		} else {
+			f.Layers = append(f.Layers, bf)
+		}
+	}
+	return f, nil
+}
+
+// cap 第一层的位数（计数布隆过滤器为计数器个数）
+func (f *BloomFilterWithTime) cap() uint {
+	if f.CBF != nil {
+		return f.CBF.Cap()
+	}
+	return f.BF.Cap()
+}
+
+// k 第一层的哈希函数个数
+func (f *BloomFilterWithTime) k() uint {
+	if f.CBF != nil {
+		return f.CBF.K()
+	}
+	return f.BF.K()
+}
+
+// bits 所有层的位数（计数布隆过滤器为计数器个数）
+func (f *BloomFilterWithTime) bits() uint64 {
+	if f.CBF != nil {
+		return uint64(f.CBF.Cap())
+	}
+	n := uint64(0)
+	for _, layer := range f.allLayers() {
+		n += uint64(layer.Cap())
+	}
+	return n
+}
+
+// setBits 所有层已置位（非零）的个数
+func (f *BloomFilterWithTime) setBits() uint64 {
+	if f.CBF != nil {
+		return uint64(f.CBF.Count())
+	}
+	n := uint64(0)
+	for _, layer := range f.allLayers() {
+		n += uint64(layer.BitSet().Count())
+	}
+	return n
+}
+
+// fill 当前写入层已置位（非零）的比例
+func (f *BloomFilterWithTime) fill() float64 {
+	if f.CBF != nil {
+		return float64(f.CBF.Count()) / float64(f.CBF.Cap())
+	}
+	last := f.lastLayer()
+	return float64(last.BitSet().Count()) / float64(last.Cap())
+}
+
+// fpRate 按各层填充率估算的整体误判率
+func (f *BloomFilterWithTime) fpRate() float64 {
+	if f.CBF != nil {
+		return math.Pow(f.fill(), float64(f.CBF.K()))
+	}
+	// 1 - ∏(1 - p)，用 log1p/expm1 计算，各层误判率很小时不会被舍入为 0
+	logPass := 0.0
+	for _, layer := range f.allLayers() {
+		fill := float64(layer.BitSet().Count()) / float64(layer.Cap())
+		logPass += math.Log1p(-math.Pow(fill, float64(layer.K())))
+	}
+	return -math.Expm1(logPass)
+}
+
+// approximatedSize 估算写入的 key 数（各层之和）
+func (f *BloomFilterWithTime) approximatedSize() uint32 {
+	if f.CBF != nil {
+		return f.CBF.ApproximatedSize()
+	}
+	n := uint32(0)
+	for _, layer := range f.allLayers() {
+		n += layer.ApproximatedSize()
+	}
+	return n
+}
+
+// sizeBytes 过滤器占用的内存（各层之和）
+func (f *BloomFilterWithTime) sizeBytes() uint64 {
+	if f.CBF != nil {
+		return uint64(len(f.CBF.counters))
+	}
+	n := uint64(0)
+	for _, layer := range f.allLayers() {
+		n += uint64(layer.Cap()) / 8
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// 桶容量自适应：
+//   - 新桶按最近几天同一时段的基数估算容量，不再一律按配置的上限分配，安静时段节省内存；
+//   - 写入时定期估算最后一层的误判率，超过该层目标后追加一层容量翻倍、误判率减半的布隆过滤器（scalable bloom filter），
+//     峰值时段不会饱和。各层误判率之和不超过配置误判率的 2 倍
+const (
+	capacityHistoryDays = 7     // 保留最近 7 天同一时段的基数
+	capacityHeadroom    = 1.25  // 按历史峰值的 1.25 倍分配
+	minBucketCapacity   = 1_000 // 分片内每个桶的最小容量
+	layerGrowth         = 2     // 扩容层的容量倍数
+	layerTightening     = 0.5   // 扩容层的误判率比例
+	layerCheckFraction  = 16    // 每写入该层容量的 1/16 估算一次误判率
+	maxLayers           = 16    // 每个桶最多的层数
+)
+
+// layers 桶在本地写入的布隆过滤器层（BF 和扩容层），计数布隆过滤器返回 nil
+func (f *BloomFilterWithTime) layers() []*bloom.BloomFilter {
+	if f.BF == nil {
+		return nil
+	}
+	return append([]*bloom.BloomFilter{f.BF}, f.Layers...)
+}
+
+// allLayers 本地的层和从对端合并来的层，用于统计
+func (f *BloomFilterWithTime) allLayers() []*bloom.BloomFilter {
+	return append(f.layers(), f.Remote...)
+}
+
+// numLayers 层数，计数布隆过滤器为 1
+func (f *BloomFilterWithTime) numLayers() int {
+	return 1 + len(f.Layers) + len(f.Remote)
+}
+
+// lastLayer 当前写入的层
+func (f *BloomFilterWithTime) lastLayer() *bloom.BloomFilter {
+	if len(f.Layers) > 0 {
+		return f.Layers[len(f.Layers)-1]
+	}
+	return f.BF
+}
+
+// layerCapacity 按位数和误判率反推一层的容量
+func layerCapacity(m uint, fp float64) uint {
+	return uint(float64(m) * math.Ln2 * math.Ln2 / -math.Log(fp))
+}
+
+// maybeGrow 写入后调用：最后一层的估算误判率超过目标时追加一层，调用方需持有锁
+func (s *bloomShard) maybeGrow(f *BloomFilterWithTime) {
+	if f.BF == nil {
+		return // 计数布隆过滤器不扩容
+	}
+	f.added++
+	if f.added < f.checkAt {
+		return
+	}
+
+	last := f.lastLayer()
+	target := s.config.FalsePositive * math.Pow(layerTightening, float64(len(f.Layers)))
+	capacity := layerCapacity(last.Cap(), target)
+	if f.checkAt == 0 {
+		// 新建或刚加载的桶，写入一段时间后再估算，不在第一次写入时扫描整个位图
+		f.checkAt = f.added + capacity/layerCheckFraction + 1
+		return
+	}
+	fill := float64(last.BitSet().Count()) / float64(last.Cap())
+	if math.Pow(fill, float64(last.K())) <= target || len(f.Layers)+1 >= maxLayers {
+		f.checkAt = f.added + capacity/layerCheckFraction + 1
+		return
+	}
+
+	f.Layers = append(f.Layers, bloom.NewWithEstimates(capacity*layerGrowth, target*layerTightening))
+	f.added = 0
+	f.checkAt = capacity * layerGrowth / layerCheckFraction
+	s.logger().Info("估算误判率超过目标，扩容",
+		"bucket", time.Unix(f.Timestamp, 0).Format("2006-01-02 15:04"), "target", target, "layers", len(f.Layers)+1)
+}
+
+// daySlot 桶在一天中的时段，用于和前几天同一时段比较；桶粒度能整除一天（由 NamespaceConfig.Validate 保证）
+func (s *bloomShard) daySlot(ts int64) int64 {
+	const day = int64(24 * time.Hour / time.Second)
+	return (ts % day) / s.bucketSeconds()
+}
+
+// observe 记录一个已经写完的桶的基数，在恢复和桶被淘汰时调用，每个桶只记录一次，调用方需持有锁
+func (s *bloomShard) observe(f *BloomFilterWithTime) {
+	if f.observed {
+		return
+	}
+	f.observed = true
+	slot := s.daySlot(f.Timestamp)
+	counts := append(s.history[slot], uint(f.approximatedSize()))
+	if len(counts) > capacityHistoryDays {
+		counts = counts[len(counts)-capacityHistoryDays:]
+	}
+	s.history[slot] = counts
+}
+
+// sizeFor 按历史同一时段的峰值估算新桶容量，没有历史时使用配置的容量
+func (s *bloomShard) sizeFor(ts int64) uint {
+	counts := s.history[s.daySlot(ts)]
+	if len(counts) == 0 {
+		return s.capacity
+	}
+	peak := uint(0)
+	for _, n := range counts {
+		peak = max(peak, n)
+	}
+	return min(max(uint(float64(peak)*capacityHeadroom), minBucketCapacity), s.capacity)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 每个区域记录最后一个完整拉取的分钟（watermark）。每次调度从 watermark 之后按顺序补齐到上一分钟，
+// 重启、COS 故障或处理变慢时错过的分钟不会丢失；落后太多时只补最近 MaxCatchUp 内的分钟
+const (
+	WatermarkPath     = "./adx_watermark.json"
+	WatermarkBackend  = "local"
+	MaxCatchUp        = 2 * time.Hour
+	watermarkRedisKey = "adx:watermark"
+)
+
+// WatermarkStore 持久化每个区域的 watermark
+type WatermarkStore interface {
+	// Load 返回所有区域的 watermark，没有记录的区域不在结果中
+	Load() (map[Region]time.Time, error)
+	Save(region Region, minute time.Time) error
+	String() string
+}
+
+// newWatermarkStore 按名称创建 watermark 存储：local（写在 path）、redis。redis 需要先调用 InitClients
+func newWatermarkStore(backend, path string) (WatermarkStore, error) {
+	switch backend {
+	case "", "local":
+		return NewFileWatermarkStore(path), nil
+	case "redis":
+		if RedisClient == nil {
+			return nil, errors.New("Redis 客户端未初始化")
+		}
+		return NewRedisWatermarkStore(RedisClient, watermarkRedisKey), nil
+	default:
+		return nil, fmt.Errorf("不支持的 watermark 存储: %q", backend)
+	}
+}
+
+// FileWatermarkStore 本地 JSON 文件，区域 -> 分钟，原子地整体覆盖
+type FileWatermarkStore struct {
+	path       string
+	mtx        chan struct{}
+	watermarks map[Region]time.Time
+}
+
+func NewFileWatermarkStore(path string) *FileWatermarkStore {
+	s := &FileWatermarkStore{path: path, mtx: make(chan struct{}, 1), watermarks: make(map[Region]time.Time)}
+	s.mtx <- struct{}{}
+	return s
+}
+
+func (s *FileWatermarkStore) String() string {
+	return "local:" + s.path
+}
+
+func (s *FileWatermarkStore) Load() (map[Region]time.Time, error) {
+	<-s.mtx
+	defer func() { s.mtx <- struct{}{} }()
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return map[Region]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	watermarks := make(map[Region]time.Time)
+	if err := json.Unmarshal(data, &watermarks); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", s.path, err)
+	}
+	s.watermarks = watermarks
+	return copyWatermarks(watermarks), nil
+}
+
+func (s *FileWatermarkStore) Save(region Region, minute time.Time) error {
+	<-s.mtx
+	defer func() { s.mtx <- struct{}{} }()
+
+	s.watermarks[region] = minute
+	return NewLocalSnapshotStore(filepath.Dir(s.path)).Save(filepath.Base(s.path), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s.watermarks)
+	})
+}
+
+// RedisWatermarkStore Redis hash，区域 -> RFC3339 格式的分钟，多个实例共享
+type RedisWatermarkStore struct {
+	client *redis.Client
+	key    string
+}
+
+func NewRedisWatermarkStore(client *redis.Client, key string) *RedisWatermarkStore {
+	return &RedisWatermarkStore{client: client, key: key}
+}
+
+func (s *RedisWatermarkStore) String() string {
+	return "redis:" + s.key
+}
+
+func (s *RedisWatermarkStore) Load() (map[Region]time.Time, error) {
+	values, err := s.client.HGetAll(context.Background(), s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	watermarks := make(map[Region]time.Time, len(values))
+	for region, v := range values {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("区域 %s 的 watermark 无效: %w", region, err)
+		}
+		watermarks[Region(region)] = t
+	}
+	return watermarks, nil
+}
+
+func (s *RedisWatermarkStore) Save(region Region, minute time.Time) error {
+	return s.client.HSet(context.Background(), s.key, string(region), minute.Format(time.RFC3339)).Err()
+}
+
+func copyWatermarks(m map[Region]time.Time) map[Region]time.Time {
+	c := make(map[Region]time.Time, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// FetchCheckpoint 按 watermark 补齐各区域错过的分钟
+type FetchCheckpoint struct {
+	store      WatermarkStore
+	maxCatchUp time.Duration
+	mtx        chan struct{} // 同一时间只有一次补齐
+	watermarks map[Region]time.Time
+}
+
+// NewFetchCheckpoint 从 store 加载 watermark
+func NewFetchCheckpoint(store WatermarkStore, maxCatchUp time.Duration) (*FetchCheckpoint, error) {
+	watermarks, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("加载 watermark 失败: %w", err)
+	}
+	c := &FetchCheckpoint{store: store, maxCatchUp: maxCatchUp, mtx: make(chan struct{}, 1), watermarks: watermarks}
+	c.mtx <- struct{}{}
+	return c, nil
+}
+
+// Watermarks 当前各区域的 watermark
+func (c *FetchCheckpoint) Watermarks() map[Region]time.Time {
+	<-c.mtx
+	defer func() { c.mtx <- struct{}{} }()
+	return copyWatermarks(c.watermarks)
+}
+
+// CatchUp 按顺序处理各区域 watermark 之后到 target（含）的所有分钟，返回处理的分钟数。
+// 同一分钟需要补的区域一起交给 process，process 返回拉取完成的区域，这些区域的 watermark 前进并持久化；
+// 某个区域失败后本次不再处理它之后的分钟，下次调度从失败的分钟重试。
+// 没有 watermark 的区域从 target 开始，落后超过 maxCatchUp 的区域跳过更早的分钟
+func (c *FetchCheckpoint) CatchUp(target time.Time, process func(minute time.Time, regions []Region) []Region) int {
+	<-c.mtx
+	defer func() { c.mtx <- struct{}{} }()
+
+	target = target.Truncate(time.Minute)
+	logger := slog.With("target", target.Format("20060102 15:04"))
+	oldest := target.Add(-c.maxCatchUp)
+	for _, r := range Regions {
+		wm, ok := c.watermarks[r]
+		switch {
+		case !ok:
+			c.watermarks[r] = target.Add(-time.Minute)
+		case wm.Before(oldest):
+			skipped := int(oldest.Sub(wm) / time.Minute)
+			logger.Warn("落后太多，跳过更早的分钟", "region", r, "watermark", wm.Format("20060102 15:04"), "skipped", skipped)
+			fetchSkippedMinutes.WithLabelValues(string(r)).Add(float64(skipped))
+			c.watermarks[r] = oldest
+		}
+	}
+
+	processed := 0
+	failed := make(map[Region]bool)
+	for minute := c.oldestWatermark().Add(time.Minute); !minute.After(target); minute = minute.Add(time.Minute) {
+		var regions []Region
+		for _, r := range Regions {
+			if !failed[r] && c.watermarks[r].Before(minute) {
+				regions = append(regions, r)
+			}
+		}
+		if len(regions) == 0 {
+			continue // 失败的区域之后的分钟，其他区域已经处理过
+		}
+
+		done := make(map[Region]bool)
+		for _, r := range process(minute, regions) {
+			done[r] = true
+		}
+		processed++
+		for _, r := range regions {
+			if !done[r] {
+				failed[r] = true
+				continue
+			}
+			c.watermarks[r] = minute
+			if err := c.store.Save(r, minute); err != nil {
+				logger.Error("保存 watermark 失败", "region", r, "store", c.store.String(), "error", err)
+			}
+		}
+		c.updateLag(target)
+	}
+	c.updateLag(target)
+	return processed
+}
+
+// oldestWatermark 所有区域中最早的 watermark，调用方需持有锁
+func (c *FetchCheckpoint) oldestWatermark() time.Time {
+	var oldest time.Time
+	for _, r := range Regions {
+		if wm := c.watermarks[r]; oldest.IsZero() || wm.Before(oldest) {
+			oldest = wm
+		}
+	}
+	return oldest
+}
+
+// updateLag 更新各区域落后 target 的分钟数，调用方需持有锁
+func (c *FetchCheckpoint) updateLag(target time.Time) {
+	for _, r := range Regions {
+		fetchLag.WithLabelValues(string(r)).Set(target.Sub(c.watermarks[r]).Minutes())
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置按以下顺序加载，后面的覆盖前面的：代码中的默认值 -> 配置文件（JSON）-> 环境变量 -> 命令行参数。
+// 配置文件路径由 -config 或 PANDO_CONFIG 指定，默认 ConfigPath，默认路径的文件不存在时只用默认值，示例见 pando-bloom.example.json。
+// 密钥（COS 和 RTA 的密钥）没有默认值，必须通过配置文件或环境变量提供；Redis 没有密码时 redis.password 可以不填；
+// 配置了 replication.peers 时必须提供 replication.token
+const (
+	ConfigPath      = "./pando-bloom.json"
+	ConfigEnv       = "PANDO_CONFIG"
+	configEnvPrefix = "PANDO_"
+)
+
+// Config 服务配置
+type Config struct {
+	HTTPPort    string            `json:"httpPort"` // 监听地址，如 ":8080"
+	Log         LogConfig         `json:"log"`
+	Redis       RedisConfig       `json:"redis"`
+	Cos         CosConfig         `json:"cos"`
+	Fetch       FetchConfig       `json:"fetch"`
+	Checkpoint  CheckpointConfig  `json:"checkpoint"`
+	Rta         RtaConfig         `json:"rta"`
+	DDJ         DDJConfig         `json:"ddj"`
+	Bloom       BloomConfig       `json:"bloom"`
+	Replication ReplicationConfig `json:"replication"` // 没有对端时不启用复制
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`  // debug、info、warn、error
+	Format string `json:"format"` // json、text
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+}
+
+// CosConfig ADX 日志所在的 COS 桶，每个区域一个
+type CosConfig struct {
+	SecretID  string            `json:"secretId"`
+	SecretKey string            `json:"secretKey"`
+	Endpoints map[Region]string `json:"endpoints"` // 区域 -> 桶地址
+}
+
+// FetchConfig 每分钟从 COS 拉取 ADX 日志的并发和重试
+type FetchConfig struct {
+	Workers      int      `json:"workers"`      // 每个区域同时下载的对象数
+	Retries      int      `json:"retries"`      // 列表每页和每个对象失败后的重试次数
+	RetryBackoff Duration `json:"retryBackoff"` // 第一次重试前的等待，之后每次翻倍
+	MaxLineBytes int      `json:"maxLineBytes"` // 单行的最大字节数，超过的行丢弃
+}
+
+// CheckpointConfig 每个区域拉取进度（watermark）的存储和补齐范围
+type CheckpointConfig struct {
+	Backend    string   `json:"backend"`    // local、redis
+	Path       string   `json:"path"`       // local 时的文件路径
+	MaxCatchUp Duration `json:"maxCatchUp"` // 最多补齐多久以前的分钟
+}
+
+type RtaConfig struct {
+	ZhikeAK  string `json:"zhikeAk"`
+	ZhikeSK  string `json:"zhikeSk"`
+	VikingAK string `json:"vikingAk"`
+	VikingSK string `json:"vikingSk"`
+}
+
+// DDJConfig 接收数据的 DDJ 机器，每次随机选一台
+type DDJConfig struct {
+	Machines []string `json:"machines"` // 机器 IP
+	Port     int      `json:"port"`
+	Path     string   `json:"path"`
+}
+
+// BloomConfig 默认命名空间的布隆过滤器参数和状态文件
+type BloomConfig struct {
+	StatePath       string   `json:"statePath"`       // 默认命名空间的状态文件
+	NamespacesPath  string   `json:"namespacesPath"`  // 按需创建的命名空间列表
+	MaxNamespaces   int      `json:"maxNamespaces"`   // 最多的命名空间个数（含默认命名空间），达到后不再按需创建
+	MaxMemoryMB     int      `json:"maxMemoryMB"`     // 所有命名空间的桶合计最多占用的内存（MB），超过时不再创建
+	SnapshotBackend string   `json:"snapshotBackend"` // 快照存储：local、cos、redis
+	Window          Duration `json:"window"`
+	Bucket          Duration `json:"bucket"`
+	Capacity        uint     `json:"capacity"`
+	FalsePositive   float64  `json:"falsePositive"`
+	Shards          int      `json:"shards"`
+}
+
+// DefaultConfig 默认配置，沿用原有的常量，不包含密钥
+func DefaultConfig() Config {
+	return Config{
+		HTTPPort: HTTPPort,
+		Log:      LogConfig{Level: LogLevel, Format: LogFormat},
+		Redis:    RedisConfig{Addr: RedisAddr},
+		Cos: CosConfig{
+			Endpoints: map[Region]string{RegionDE: EpDe, RegionSG: EpSg, RegionUS: EpUs},
+		},
+		Fetch: FetchConfig{
+			Workers:      AdxDownloadWorkers,
+			Retries:      AdxRetries,
+			RetryBackoff: Duration(AdxRetryBackoff),
+			MaxLineBytes: AdxMaxLineBytes,
+		},
+		Checkpoint: CheckpointConfig{
+			Backend:    WatermarkBackend,
+			Path:       WatermarkPath,
+			MaxCatchUp: Duration(MaxCatchUp),
+		},
+		DDJ: DDJConfig{
+			Machines: []string{
+				"172.31.17.231",
+				"172.31.24.96",
+				"172.31.22.157",
+				"172.31.25.93",
+				"172.31.21.96",
+				"172.31.16.65",
+				"172.31.17.148",
+				"172.31.20.249",
+			},
+			Port: DDJPort,
+			Path: DDJPath,
+		},
+		Bloom: BloomConfig{
+			StatePath:       StateFilePath,
+			NamespacesPath:  NamespaceConfigPath,
+			MaxNamespaces:   MaxNamespaces,
+			MaxMemoryMB:     MaxNamespaceMemoryMB,
+			SnapshotBackend: SnapshotBackend,
+			Window:          Duration(NumHours * BucketDuration),
+			Bucket:          Duration(BucketDuration),
+			Capacity:        HourlyCount,
+			FalsePositive:   FalsePositive,
+			Shards:          DefaultShards,
+		},
+		Replication: ReplicationConfig{Interval: Duration(ReplicationInterval)},
+	}
+}
+
+// NamespaceConfig 默认命名空间的配置
+func (c BloomConfig) NamespaceConfig() NamespaceConfig {
+	config := DefaultNamespaceConfig()
+	config.Window = c.Window
+	config.Bucket = c.Bucket
+	config.Capacity = c.Capacity
+	config.FalsePositive = c.FalsePositive
+	config.Shards = c.Shards
+	return config
+}
+
+// Validate 校验配置，返回所有问题
+func (c Config) Validate() error {
+	var errs []error
+	if c.HTTPPort == "" {
+		errs = append(errs, errors.New("httpPort 不能为空"))
+	}
+	if _, err := newLogger(io.Discard, c.Log.Level, c.Log.Format); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if c.Redis.Addr == "" {
+		errs = append(errs, errors.New("redis.addr 不能为空"))
+	}
+	if c.Cos.SecretID == "" || c.Cos.SecretKey == "" {
+		errs = append(errs, errors.New("cos.secretId 和 cos.secretKey 不能为空"))
+	}
+	for _, r := range Regions {
+		if c.Cos.Endpoints[r] == "" {
+			errs = append(errs, fmt.Errorf("缺少区域 %s 的 cos.endpoints", r))
+		}
+	}
+	if c.Fetch.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("fetch.workers 必须大于 0: %d", c.Fetch.Workers))
+	}
+	if c.Fetch.MaxLineBytes <= 0 {
+		errs = append(errs, fmt.Errorf("fetch.maxLineBytes 必须大于 0: %d", c.Fetch.MaxLineBytes))
+	}
+	if c.Fetch.Retries < 0 || c.Fetch.RetryBackoff < 0 {
+		errs = append(errs, errors.New("fetch.retries 和 fetch.retryBackoff 不能为负"))
+	}
+	switch c.Checkpoint.Backend {
+	case "local":
+		if c.Checkpoint.Path == "" {
+			errs = append(errs, errors.New("checkpoint.path 不能为空"))
+		}
+	case "redis":
+	default:
+		errs = append(errs, fmt.Errorf("不支持的 checkpoint.backend: %q", c.Checkpoint.Backend))
+	}
+	if c.Checkpoint.MaxCatchUp.Duration() < time.Minute {
+		errs = append(errs, fmt.Errorf("checkpoint.maxCatchUp 至少 1m: %s", c.Checkpoint.MaxCatchUp.Duration()))
+	}
+	if c.Rta.ZhikeAK == "" || c.Rta.ZhikeSK == "" || c.Rta.VikingAK == "" || c.Rta.VikingSK == "" {
+		errs = append(errs, errors.New("rta.zhikeAk、rta.zhikeSk、rta.vikingAk 和 rta.vikingSk 不能为空"))
+	}
+	if len(c.DDJ.Machines) == 0 {
+		errs = append(errs, errors.New("ddj.machines 不能为空"))
+	}
+	if c.DDJ.Port <= 0 || c.DDJ.Port > 65535 {
+		errs = append(errs, fmt.Errorf("ddj.port 超出范围: %d", c.DDJ.Port))
+	}
+	if !strings.HasPrefix(c.DDJ.Path, "/") {
+		errs = append(errs, fmt.Errorf("ddj.path 必须以 / 开头: %q", c.DDJ.Path))
+	}
+	if c.Bloom.StatePath == "" {
+		errs = append(errs, errors.New("bloom.statePath 不能为空"))
+	}
+	if c.Bloom.MaxNamespaces < 1 {
+		errs = append(errs, fmt.Errorf("bloom.maxNamespaces 至少为 1: %d", c.Bloom.MaxNamespaces))
+	}
+	switch c.Bloom.SnapshotBackend {
+	case "local", "cos", "redis":
+	default:
+		errs = append(errs, fmt.Errorf("不支持的 bloom.snapshotBackend: %q", c.Bloom.SnapshotBackend))
+	}
+	if err := c.Bloom.NamespaceConfig().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("bloom: %w", err))
+	} else if need := c.Bloom.NamespaceConfig().MemoryMB(); float64(c.Bloom.MaxMemoryMB) < need {
+		errs = append(errs, fmt.Errorf("bloom.maxMemoryMB 小于默认命名空间需要的 %.0fMB: %d", need, c.Bloom.MaxMemoryMB))
+	}
+	if len(c.Replication.Peers) > 0 && c.Replication.Token == "" {
+		errs = append(errs, errors.New("配置了 replication.peers 时 replication.token 不能为空"))
+	}
+	if c.Replication.Interval.Duration() < time.Second {
+		errs = append(errs, fmt.Errorf("replication.interval 至少 1s: %s", c.Replication.Interval.Duration()))
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig 按默认值、配置文件、环境变量、命令行参数的顺序加载配置并校验
+func LoadConfig(args []string, getenv func(string) string) (Config, error) {
+	config := DefaultConfig()
+
+	fs := flag.NewFlagSet("pando-bloom", flag.ContinueOnError)
+	path := fs.String("config", "", "配置文件路径，默认 "+ConfigPath)
+	port := fs.String("port", "", "监听地址，如 :8080")
+	logLevel := fs.String("log-level", "", "日志级别：debug、info、warn、error")
+	logFormat := fs.String("log-format", "", "日志格式：json、text")
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+
+	configPath := *path
+	if configPath == "" {
+		configPath = getenv(ConfigEnv)
+	}
+	if err := config.loadFile(configPath); err != nil {
+		return config, err
+	}
+	if err := config.applyEnv(getenv); err != nil {
+		return config, err
+	}
+
+	// 命令行参数只覆盖显式传入的
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.HTTPPort = *port
+		case "log-level":
+			config.Log.Level = *logLevel
+		case "log-format":
+			config.Log.Format = *logFormat
+		}
+	})
+
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("配置无效:\n%w", err)
+	}
+	return config, nil
+}
+
+// runCheckConfig 子命令 check-config：按服务启动时的方式加载并校验配置，不启动服务，用于重启前检查。
+// 参数同服务启动参数，如 check-config -config ./pando-bloom.json；配置有效返回 0，无效返回 2
+func runCheckConfig(args []string) int {
+	if _, err := LoadConfig(args, os.Getenv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println("配置有效")
+	return 0
+}
+
+// loadFile 把配置文件覆盖到当前配置上，文件中没有的字段保持不变；path 为空时读取默认路径，默认路径不存在不是错误
+func (c *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = ConfigPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	return nil
+}
+
+// envOverrides 环境变量（去掉 PANDO_ 前缀）-> 覆盖的字段
+func (c *Config) envOverrides() map[string]func(string) error {
+	str := func(p *string) func(string) error {
+		return func(v string) error { *p = v; return nil }
+	}
+	overrides := map[string]func(string) error{
+		"HTTP_PORT":          str(&c.HTTPPort),
+		"LOG_LEVEL":          str(&c.Log.Level),
+		"LOG_FORMAT":         str(&c.Log.Format),
+		"REDIS_ADDR":         str(&c.Redis.Addr),
+		"REDIS_PASSWORD":     str(&c.Redis.Password),
+		"REPLICATION_TOKEN":  str(&c.Replication.Token),
+		"COS_SECRET_ID":      str(&c.Cos.SecretID),
+		"COS_SECRET_KEY":     str(&c.Cos.SecretKey),
+		"RTA_ZHIKE_AK":       str(&c.Rta.ZhikeAK),
+		"RTA_ZHIKE_SK":       str(&c.Rta.ZhikeSK),
+		"RTA_VIKING_AK":      str(&c.Rta.VikingAK),
+		"RTA_VIKING_SK":      str(&c.Rta.VikingSK),
+		"DDJ_PATH":           str(&c.DDJ.Path),
+		"STATE_PATH":         str(&c.Bloom.StatePath),
+		"CHECKPOINT_BACKEND": str(&c.Checkpoint.Backend),
+		"CHECKPOINT_PATH":    str(&c.Checkpoint.Path),
+		"SNAPSHOT_BACKEND":   str(&c.Bloom.SnapshotBackend),
+		"REDIS_DB": func(v string) (err error) {
+			c.Redis.DB, err = strconv.Atoi(v)
+			return err
+		},
+		"FETCH_WORKERS": func(v string) (err error) {
+			c.Fetch.Workers, err = strconv.Atoi(v)
+			return err
+		},
+		"FETCH_RETRIES": func(v string) (err error) {
+			c.Fetch.Retries, err = strconv.Atoi(v)
+			return err
+		},
+		"FETCH_MAX_LINE_BYTES": func(v string) (err error) {
+			c.Fetch.MaxLineBytes, err = strconv.Atoi(v)
+			return err
+		},
+		"FETCH_RETRY_BACKOFF": func(v string) error {
+			d, err := time.ParseDuration(v)
+			c.Fetch.RetryBackoff = Duration(d)
+			return err
+		},
+		"CHECKPOINT_MAX_CATCH_UP": func(v string) error {
+			d, err := time.ParseDuration(v)
+			c.Checkpoint.MaxCatchUp = Duration(d)
+			return err
+		},
+		"DDJ_PORT": func(v string) (err error) {
+			c.DDJ.Port, err = strconv.Atoi(v)
+			return err
+		},
+		"DDJ_MACHINES": func(v string) error {
+			c.DDJ.Machines = strings.Split(v, ",")
+			return nil
+		},
+		"BLOOM_WINDOW": func(v string) error {
+			d, err := time.ParseDuration(v)
+			c.Bloom.Window = Duration(d)
+			return err
+		},
+		"BLOOM_BUCKET": func(v string) error {
+			d, err := time.ParseDuration(v)
+			c.Bloom.Bucket = Duration(d)
+			return err
+		},
+		"BLOOM_CAPACITY": func(v string) error {
+			n, err := strconv.ParseUint(v, 10, 0)
+			c.Bloom.Capacity = uint(n)
+			return err
+		},
+		"BLOOM_FALSE_POSITIVE": func(v string) (err error) {
+			c.Bloom.FalsePositive, err = strconv.ParseFloat(v, 64)
+			return err
+		},
+		"BLOOM_SHARDS": func(v string) (err error) {
+			c.Bloom.Shards, err = strconv.Atoi(v)
+			return err
+		},
+		"BLOOM_MAX_NAMESPACES": func(v string) (err error) {
+			c.Bloom.MaxNamespaces, err = strconv.Atoi(v)
+			return err
+		},
+		"BLOOM_MAX_MEMORY_MB": func(v string) (err error) {
+			c.Bloom.MaxMemoryMB, err = strconv.Atoi(v)
+			return err
+		},
+		"REPLICATION_PEERS": func(v string) error {
+			c.Replication.Peers = strings.Split(v, ",")
+			return nil
+		},
+		"REPLICATION_INTERVAL": func(v string) error {
+			d, err := time.ParseDuration(v)
+			c.Replication.Interval = Duration(d)
+			return err
+		},
+	}
+	for _, r := range Regions {
+		overrides["COS_ENDPOINT_"+strings.ToUpper(string(r))] = func(v string) error {
+			if c.Cos.Endpoints == nil {
+				c.Cos.Endpoints = make(map[Region]string)
+			}
+			c.Cos.Endpoints[r] = v
+			return nil
+		}
+	}
+	return overrides
+}
+
+// applyEnv 用 PANDO_ 开头的环境变量覆盖配置
+func (c *Config) applyEnv(getenv func(string) string) error {
+	for name, apply := range c.envOverrides() {
+		v := getenv(configEnvPrefix + name)
+		if v == "" {
+			continue
+		}
+		if err := apply(v); err != nil {
+			return fmt.Errorf("环境变量 %s%s 无效: %w", configEnvPrefix, name, err)
+		}
+	}
+	return nil
+}
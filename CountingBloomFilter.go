@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+const countingMax = 0x0f // 4 位计数器的上限，达到上限后不再增减，避免删除其他 key 时产生漏判
+
+// CountingBloomFilter 计数布隆过滤器：每个位置是一个 4 位计数器，支持删除。
+// 哈希位置与 bloom.BloomFilter 相同，内存是同参数布隆过滤器的 4 倍
+type CountingBloomFilter struct {
+	m        uint
+	k        uint
+	counters []byte // 每个字节存两个计数器
+}
+
+func NewCountingBloomFilter(m, k uint) *CountingBloomFilter {
+	if m < 1 {
+		m = 1
+	}
+	if k < 1 {
+		k = 1
+	}
+	return &CountingBloomFilter{m: m, k: k, counters: make([]byte, (m+1)/2)}
+}
+
+// NewCountingWithEstimates 按预估容量和误判率创建，参数与 bloom.NewWithEstimates 一致
+func NewCountingWithEstimates(n uint, fp float64) *CountingBloomFilter {
+	m, k := bloom.EstimateParameters(n, fp)
+	return NewCountingBloomFilter(m, k)
+}
+
+func (f *CountingBloomFilter) Cap() uint {
+	return f.m
+}
+
+func (f *CountingBloomFilter) K() uint {
+	return f.k
+}
+
+func (f *CountingBloomFilter) get(i uint) byte {
+	b := f.counters[i/2]
+	if i%2 == 0 {
+		return b & 0x0f
+	}
+	return b >> 4
+}
+
+func (f *CountingBloomFilter) set(i uint, v byte) {
+	if i%2 == 0 {
+		f.counters[i/2] = f.counters[i/2]&0xf0 | v
+	} else {
+		f.counters[i/2] = f.counters[i/2]&0x0f | v<<4
+	}
+}
+
+func (f *CountingBloomFilter) locations(key string) []uint64 {
+	locations := bloom.Locations([]byte(key), f.k)
+	for i := range locations {
+		locations[i] %= uint64(f.m)
+	}
+	return locations
+}
+
+func (f *CountingBloomFilter) AddString(key string) {
+	for _, loc := range f.locations(key) {
+		if c := f.get(uint(loc)); c < countingMax {
+			f.set(uint(loc), c+1)
+		}
+	}
+}
+
+func (f *CountingBloomFilter) TestString(key string) bool {
+	for _, loc := range f.locations(key) {
+		if f.get(uint(loc)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveString 删除 key，key 不存在时返回 false。只应删除确实写入过的 key，删除误判的 key 会让其他 key 漏判
+func (f *CountingBloomFilter) RemoveString(key string) bool {
+	locations := f.locations(key)
+	for _, loc := range locations {
+		if f.get(uint(loc)) == 0 {
+			return false
+		}
+	}
+	for _, loc := range locations {
+		if c := f.get(uint(loc)); c < countingMax {
+			f.set(uint(loc), c-1)
+		}
+	}
+	return true
+}
+
+// Merge 按计数器取最大值合并，两边写入过的同一个 key 不会被重复计数
+func (f *CountingBloomFilter) Merge(g *CountingBloomFilter) error {
+	if f.m != g.m || f.k != g.k {
+		return fmt.Errorf("m/k 不一致: %d/%d 与 %d/%d", f.m, f.k, g.m, g.k)
+	}
+	for i := uint(0); i < f.m; i++ {
+		if c := g.get(i); c > f.get(i) {
+			f.set(i, c)
+		}
+	}
+	return nil
+}
+
+// Count 非零计数器的个数
+func (f *CountingBloomFilter) Count() uint {
+	n := uint(0)
+	for _, b := range f.counters {
+		if b&0x0f != 0 {
+			n++
+		}
+		if b>>4 != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// ApproximatedSize 按非零计数器比例估算写入的 key 数，与 bloom.BloomFilter.ApproximatedSize 相同的公式
+func (f *CountingBloomFilter) ApproximatedSize() uint32 {
+	x := float64(f.Count())
+	m := float64(f.m)
+	k := float64(f.k)
+	size := -1 * m / k * math.Log(1-x/m)
+	return uint32(math.Floor(size + 0.5))
+}
+
+// GobEncode 编码：m(uint64) k(uint64) 计数器
+func (f *CountingBloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(16 + len(f.counters))
+	binary.Write(&buf, binary.BigEndian, uint64(f.m))
+	binary.Write(&buf, binary.BigEndian, uint64(f.k))
+	buf.Write(f.counters)
+	return buf.Bytes(), nil
+}
+
+func (f *CountingBloomFilter) GobDecode(data []byte) error {
+	if len(data) < 16 {
+		return errors.New("计数布隆过滤器数据过短")
+	}
+	m := binary.BigEndian.Uint64(data)
+	k := binary.BigEndian.Uint64(data[8:])
+	counters := data[16:]
+	if m == 0 || k == 0 || uint64(len(counters)) != (m+1)/2 {
+		return fmt.Errorf("计数布隆过滤器数据非法: m=%d k=%d 计数器 %d 字节", m, k, len(counters))
+	}
+	f.m = uint(m)
+	f.k = uint(k)
+	f.counters = append([]byte(nil), counters...)
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	exactRedisPrefix  = "bloom:exact:"
+	exactRetryBackoff = 10 * time.Second // Redis 不可用后多久再尝试精确去重
+	exactTimeout      = time.Second      // 单次精确去重的超时，超时后回退到布隆过滤器
+	exactFlushBatch   = 1000             // 写回时每批的 key 数
+	maxExactPending   = 1_000_000        // Redis 不可用期间最多记录的待写回 key 数
+)
+
+// ExactStore 精确去重存储：对每个 key 原子地“不存在则写入并设置过期时间”
+type ExactStore interface {
+	// SetNX 按顺序写入 keys，返回每个 key 是否为本次新写入；同一批内重复的 key 只有第一个返回 true
+	SetNX(ctx context.Context, namespace string, keys []string, ttl time.Duration) ([]bool, error)
+	// Remove 删除 keys，之后可以再次写入
+	Remove(ctx context.Context, namespace string, keys []string) error
+}
+
+// RedisExactStore 用 Redis SET NX EX 实现精确去重，一批 key 通过一次 pipeline 写入
+type RedisExactStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisExactStore(client *redis.Client, prefix string) *RedisExactStore {
+	return &RedisExactStore{client: client, prefix: prefix}
+}
+
+func (s *RedisExactStore) SetNX(ctx context.Context, namespace string, keys []string, ttl time.Duration) ([]bool, error) {
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.SetNX(ctx, s.prefix+namespace+":"+key, 1, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	isNew := make([]bool, len(keys))
+	for i, cmd := range cmds {
+		isNew[i] = cmd.Val()
+	}
+	return isNew, nil
+}
+
+func (s *RedisExactStore) Remove(ctx context.Context, namespace string, keys []string) error {
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = s.prefix + namespace + ":" + key
+	}
+	return s.client.Del(ctx, redisKeys...).Err()
+}
+
+// exactTier 命名空间的精确去重层，Redis 出错后在 exactRetryBackoff 内直接走布隆过滤器。
+// 回退期间布隆过滤器放行的 key 和 AddAt 写入 Redis 失败的 key 记在 pending 中，Redis 恢复后先写回再判断新的请求，
+// 否则这些 key 之后会被 Redis 判断为新数据
+type exactTier struct {
+	store      ExactStore
+	retryAfter atomic.Int64 // Unix 纳秒，在此之前不再尝试
+
+	pending      []exactPendingKey
+	flushing     int             // 正在写回的 key 数，写回时整个 pending 移出，只由写回的请求读写
+	removed      map[string]bool // 写回期间删除的 key，写回失败时不放回，写回成功后从 Redis 删除；不在写回时为 nil
+	maxPending   int             // pending 和正在写回的 key 合计的上限
+	pendingCount atomic.Int64    // len(pending) + flushing，没有待写回的 key 时不加锁
+	pendingMtx   chan struct{}   // 保护 pending、flushing、removed
+	flushMtx     chan struct{}   // 同一时间只有一个请求写回，其他请求在写回期间回退到布隆过滤器
+}
+
+// exactPendingKey 待写回 Redis 的 key
+type exactPendingKey struct {
+	key     string
+	expires time.Time // 写入的桶离开窗口的时间，写回时按剩余时间设置过期
+}
+
+func newExactTier(store ExactStore) *exactTier {
+	tier := &exactTier{store: store, maxPending: maxExactPending, pendingMtx: make(chan struct{}, 1), flushMtx: make(chan struct{}, 1)}
+	tier.pendingMtx <- struct{}{}
+	tier.flushMtx <- struct{}{}
+	return tier
+}
+
+// exactExpiry 写入 t 所在桶的 key 在布隆过滤器中保留到的时间，Redis 中的 key 按同一时间过期
+func (m *HourlyBloomManager) exactExpiry(t time.Time) time.Time {
+	bucket := m.config.Bucket.Duration()
+	return t.Truncate(bucket).Add(bucket + m.config.Window.Duration())
+}
+
+// setNX 尝试精确去重，key 写入 t 所在的桶；有待写回的 key 时先写回。不可用时返回 false，由调用方回退到布隆过滤器
+func (m *HourlyBloomManager) setNX(keys []string, t time.Time) ([]bool, bool) {
+	tier := m.exact
+	if tier == nil || time.Now().UnixNano() < tier.retryAfter.Load() {
+		return nil, false
+	}
+	if tier.pendingCount.Load() > 0 {
+		select {
+		case <-tier.flushMtx:
+			ok := m.flushExact()
+			tier.flushMtx <- struct{}{}
+			if !ok {
+				return nil, false
+			}
+		default:
+			return nil, false // 其他请求正在写回
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exactTimeout)
+	defer cancel()
+	isNew, err := tier.store.SetNX(ctx, m.config.Name, keys, time.Until(m.exactExpiry(t)))
+	if err != nil {
+		m.exactUnavailable(err)
+		return nil, false
+	}
+	return isNew, true
+}
+
+// exactUnavailable Redis 出错，退避一段时间
+func (m *HourlyBloomManager) exactUnavailable(err error) {
+	m.exact.retryAfter.Store(time.Now().Add(exactRetryBackoff).UnixNano())
+	m.logger().Warn("精确去重不可用，回退到布隆过滤器", "backoff", exactRetryBackoff, "error", err)
+}
+
+// dedupExact 精确去重；新的 key 同时写入布隆过滤器，Redis 不可用时回退后仍能识别
+func (m *HourlyBloomManager) dedupExact(strings []string) ([]string, bool) {
+	if m.exact != nil && len(strings) == 0 {
+		return nil, true
+	}
+	isNew, ok := m.setNX(strings, time.Now())
+	if !ok {
+		return nil, false
+	}
+
+	var records []walRecord
+	m.forEachShard(strings, func(shard *bloomShard, i int) {
+		if isNew[i] {
+			idx := shard.add(strings[i])
+			records = append(records, walRecord{Timestamp: shard.filters[idx].Timestamp, Key: strings[i]})
+		}
+	})
+	m.logWAL(records...)
+
+	var newOnes []string
+	for i, s := range strings {
+		if isNew[i] {
+			newOnes = append(newOnes, s)
+		}
+	}
+	return newOnes, true
+}
+
+// writeExact 把只写入了布隆过滤器的 key（按事件时间写入的和回退期间放行的）写入 Redis，
+// Redis 不可用时记下来，恢复后写回
+func (m *HourlyBloomManager) writeExact(keys []string, t time.Time) {
+	if m.exact == nil || len(keys) == 0 {
+		return
+	}
+	if _, ok := m.setNX(keys, t); !ok {
+		m.addPendingExact(keys, m.exactExpiry(t))
+	}
+}
+
+// addPendingExact 记下待写回的 key，超过上限时丢弃最早的
+func (m *HourlyBloomManager) addPendingExact(keys []string, expires time.Time) {
+	tier := m.exact
+	<-tier.pendingMtx
+	defer func() { tier.pendingMtx <- struct{}{} }()
+
+	for _, key := range keys {
+		tier.pending = append(tier.pending, exactPendingKey{key: key, expires: expires})
+	}
+	m.trimPendingExact()
+}
+
+// trimPendingExact 待写回的 key 超过上限时丢弃最早的，调用方需持有 pendingMtx。正在写回的 key 不在 pending 中，不会被丢弃
+func (m *HourlyBloomManager) trimPendingExact() {
+	tier := m.exact
+	if over := min(len(tier.pending)+tier.flushing-tier.maxPending, len(tier.pending)); over > 0 {
+		tier.pending = append([]exactPendingKey(nil), tier.pending[over:]...)
+		m.logger().Warn("待写回精确去重的 key 过多，丢弃最早的", "dropped", over)
+	}
+	tier.pendingCount.Store(int64(len(tier.pending) + tier.flushing))
+}
+
+// removePendingExact 删除的 key 不再写回；正在写回的记下来，由写回的请求处理
+func (m *HourlyBloomManager) removePendingExact(keys []string) {
+	tier := m.exact
+	if tier.pendingCount.Load() == 0 {
+		return
+	}
+	removed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		removed[key] = true
+	}
+
+	<-tier.pendingMtx
+	defer func() { tier.pendingMtx <- struct{}{} }()
+	tier.pending = slices.DeleteFunc(tier.pending, func(p exactPendingKey) bool { return removed[p.key] })
+	if tier.removed != nil {
+		for _, key := range keys {
+			tier.removed[key] = true
+		}
+	}
+	tier.pendingCount.Store(int64(len(tier.pending) + tier.flushing))
+}
+
+// flushExact 把待写回的 key 按批写入 Redis，返回是否全部写回，调用方需持有 flushMtx。
+// 每轮把整个 pending 移出后在锁外写回，期间新记下的 key 进入新的 pending，下一轮再写回；
+// 失败时把没有写回、也没有被删除的 key 放回 pending 的开头，留到下次
+func (m *HourlyBloomManager) flushExact() bool {
+	tier := m.exact
+	written := 0
+	for {
+		<-tier.pendingMtx
+		batch := tier.pending
+		tier.pending, tier.flushing, tier.removed = nil, len(batch), make(map[string]bool)
+		tier.pendingMtx <- struct{}{}
+		if len(batch) == 0 {
+			m.finishFlushExact(nil, nil)
+			break
+		}
+
+		for start := 0; start < len(batch); start += exactFlushBatch {
+			if err := m.writePendingExact(batch[start:min(start+exactFlushBatch, len(batch))]); err != nil {
+				m.exactUnavailable(err)
+				m.finishFlushExact(batch[:start], batch[start:])
+				return false
+			}
+		}
+		m.finishFlushExact(batch, nil)
+		written += len(batch)
+	}
+	if written > 0 {
+		m.logger().Info("已把回退期间的 key 写回精确去重", "keys", written)
+	}
+	return true
+}
+
+// writePendingExact 写回一批 key；同一个桶写入的 key 过期时间相同，按过期时间分组写入
+func (m *HourlyBloomManager) writePendingExact(batch []exactPendingKey) error {
+	groups := make(map[time.Time][]string)
+	for _, p := range batch {
+		groups[p.expires] = append(groups[p.expires], p.key)
+	}
+	for expires, keys := range groups {
+		ttl := time.Until(expires)
+		if ttl <= 0 {
+			continue // 已经离开窗口
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exactTimeout)
+		_, err := m.exact.store.SetNX(ctx, m.config.Name, keys, ttl)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishFlushExact 结束一轮写回：写回期间被删除的 key 已经写入的从 Redis 删除，没有写入的不放回；
+// 其余没有写入的 key 放回 pending 的开头
+func (m *HourlyBloomManager) finishFlushExact(written, failed []exactPendingKey) {
+	tier := m.exact
+	<-tier.pendingMtx
+	removed := tier.removed
+	failed = slices.DeleteFunc(failed, func(p exactPendingKey) bool { return removed[p.key] })
+	tier.pending = append(failed, tier.pending...)
+	tier.flushing, tier.removed = 0, nil
+	m.trimPendingExact()
+	tier.pendingMtx <- struct{}{}
+
+	var stale []string
+	for _, p := range written {
+		if removed[p.key] {
+			stale = append(stale, p.key)
+		}
+	}
+	if len(stale) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), exactTimeout)
+		defer cancel()
+		if err := tier.store.Remove(ctx, m.config.Name, stale); err != nil {
+			m.logger().Warn("从精确去重中删除写回期间删除的 key 失败", "error", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// runInspect pando-bloom inspect [path]：打印状态文件的文件头和每个桶的时间、大小、填充率和估算基数
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: pando-bloom inspect [状态文件，默认 %s]\n", StateFilePath)
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := StateFilePath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开状态文件失败: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	snap, err := readSnapshot(file)
+	if snap == nil {
+		fmt.Fprintf(os.Stderr, "读取状态文件失败: %v\n", err)
+		return 1
+	}
+
+	header := snap.header
+	fmt.Printf("文件: %s\n", path)
+	if snap.version == 0 {
+		fmt.Println("版本: 旧格式（无文件头），下次保存时迁移到当前格式")
+	} else {
+		fmt.Printf("版本: v%d\n", snap.version)
+	}
+	fmt.Printf("桶粒度: %s, 每个分片 %d 个桶, 分片数: %d\n",
+		time.Duration(header.BucketSeconds)*time.Second, header.NumBuckets, header.Shards)
+	if len(snap.frozen) > 0 {
+		fmt.Printf("分片数变化前的只读桶: %d 组\n", len(snap.frozen))
+	}
+	if header.Capacity > 0 {
+		fmt.Printf("写入时配置: 每个桶容量 %d, 误判率 %g\n", header.Capacity, header.FalsePositive)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "分片\t桶起始时间\t类型\t层数\tm\tk\t大小(MB)\t填充率\t估算基数\t估算误判率\t")
+	total := uint64(0)
+	printShard := func(shard string, filters []*BloomFilterWithTime) {
+		sort.Slice(filters, func(i, j int) bool { return filters[i].Timestamp < filters[j].Timestamp })
+		for _, f := range filters {
+			fill := f.fill()
+			estimated := f.approximatedSize()
+			total += uint64(estimated)
+			backend := BackendBloom
+			if f.kind() == filterKindCounting {
+				backend = BackendCounting
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%.1f\t%.4f\t%d\t%.6f\t\n",
+				shard,
+				time.Unix(f.Timestamp, 0).Format("2006-01-02 15:04"),
+				backend,
+				f.numLayers(),
+				f.cap(),
+				f.k(),
+				float64(f.sizeBytes())/1024/1024,
+				fill,
+				estimated,
+				f.fpRate())
+		}
+	}
+	for shard, filters := range snap.shards {
+		printShard(fmt.Sprint(shard), filters)
+	}
+	// 分片数变化前的只读桶，分片列为 只读<组>-<原来的分片>
+	for group, b := range snap.frozen {
+		for shard, filters := range b.shards {
+			printShard(fmt.Sprintf("只读%d-%d", group, shard), filters)
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n共 %d 个桶，估算总基数 %d\n", snap.numBuckets(), total)
+	if len(snap.corrupt) > 0 {
+		fmt.Printf("校验失败的桶（分片/时间）: %v\n", snap.corrupt)
+	}
+	if err != nil {
+		fmt.Printf("文件不完整: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
+
 	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
 )
 
@@ -15,14 +16,14 @@ var searcher *xdb.Searcher
 func initXdb() {
 	cBuff, err := xdb.LoadContentFromFile(dbPath)
 	if err != nil {
-		fmt.Printf("failed to load content from `%s`: %s\n", dbPath, err)
+		slog.Error("加载 IP 库失败", "path", dbPath, "error", err)
 		return
 	}
 
 	// 2、用全局的 cBuff 创建完全基于内存的查询对象。
 	searcher, err = xdb.NewWithBuffer(cBuff)
 	if err != nil {
-		fmt.Printf("failed to create searcher with content: %s\n", err)
+		slog.Error("创建 IP 查询失败", "error", err)
 		return
 	}
 }
@@ -30,7 +31,7 @@ func initXdb() {
 func searchIp(ip string) string {
 	result, err := searcher.SearchByStr(ip)
 	if err != nil {
-		fmt.Printf("failed to search ip [%s]: %s\n", ip, err)
+		slog.Debug("IP 查询失败", "ip", ip, "error", err)
 		return "unknow"
 	}
 	return result
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// 日志格式
+const (
+	LogFormatJSON = "json" // 每行一个 JSON 对象，便于日志平台检索
+	LogFormatText = "text" // key=value 格式，便于本地查看
+)
+
+// parseLogLevel 解析日志级别：debug、info、warn、error
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid log level: %s", level)
+	}
+	return l, nil
+}
+
+// newLogger 按级别和格式创建结构化日志
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+// setupLogger 设置全局日志；标准库 log 的输出也会按 info 级别转到这里
+func setupLogger(w io.Writer, level, format string) error {
+	logger, err := newLogger(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// logger 命名空间的日志，带 namespace 字段
+func (m *HourlyBloomManager) logger() *slog.Logger {
+	return slog.With("namespace", m.config.Name)
+}
+
+// logger 分片的日志，带 namespace 和 shard 字段
+func (s *bloomShard) logger() *slog.Logger {
+	return slog.With("namespace", s.config.Name, "shard", s.id)
+}
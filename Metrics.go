@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus 指标，GET /metrics 以文本格式输出。使用独立的 registry，测试中可以直接读取
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	processMinuteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pando_process_minute_duration_seconds",
+		Help:    "一次 processMinute 的耗时",
+		Buckets: []float64{1, 2, 5, 10, 20, 30, 45, 60, 90, 120},
+	})
+	adxLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_adx_lines_total",
+		Help: "从 COS 下载的 ADX 请求行数",
+	}, []string{"region"})
+	adxInvalid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_adx_invalid_total",
+		Help: "被丢弃的 ADX 请求行数，reason 为 json、oversized、gaid 或 ip",
+	}, []string{"region", "reason"})
+	adxFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_adx_fetch_errors_total",
+		Help: "拉取 COS 文件列表失败的次数",
+	}, []string{"region"})
+	adxDownloadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_adx_download_errors_total",
+		Help: "重试后仍下载失败、被跳过的 ADX 对象数",
+	}, []string{"region"})
+	fetchLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pando_adx_fetch_lag_minutes",
+		Help: "各区域最后一个完整拉取的分钟落后上一分钟的分钟数",
+	}, []string{"region"})
+	fetchSkippedMinutes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_adx_skipped_minutes_total",
+		Help: "落后超过 maxCatchUp 而放弃补齐的分钟数",
+	}, []string{"region"})
+	ddjSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_ddj_send_total",
+		Help: "发送给 DDJ 的请求数，result 为 ok 或 error",
+	}, []string{"result"})
+	ddjRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pando_ddj_records_total",
+		Help: "成功发送给 DDJ 的数据条数",
+	})
+	rtaChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_rta_checks_total",
+		Help: "RTA 检查次数，result 为 pass、reject 或 error",
+	}, []string{"result"})
+	replicationBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pando_replication_bytes_total",
+		Help: "从对端拉取的复制增量字节数",
+	}, []string{"namespace", "peer"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pando_http_request_duration_seconds",
+		Help:    "HTTP 接口耗时",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		processMinuteDuration,
+		adxLines,
+		adxInvalid,
+		adxFetchErrors,
+		adxDownloadErrors,
+		fetchLag,
+		fetchSkippedMinutes,
+		replicationBytes,
+		ddjSends,
+		ddjRecords,
+		rtaChecks,
+		httpDuration,
+	)
+}
+
+// metricsHandler GET /metrics
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// metricsMiddleware 记录每个请求的耗时，route 使用注册的路由，未匹配的请求记为 "unmatched"，避免标签基数失控
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// bloomCollector 在抓取时读取各命名空间自启动以来的调用统计（见 managerStats），不在写入路径上重复计数
+type bloomCollector struct {
+	namespaces *BloomNamespaces
+	calls      *prometheus.Desc
+	keys       *prometheus.Desc
+	hits       *prometheus.Desc
+}
+
+func newBloomCollector(namespaces *BloomNamespaces) *bloomCollector {
+	labels := []string{"namespace", "op"}
+	return &bloomCollector{
+		namespaces: namespaces,
+		calls:      prometheus.NewDesc("pando_bloom_calls_total", "去重服务的调用次数，op 为 add、contains 或 dedup", labels, nil),
+		keys:       prometheus.NewDesc("pando_bloom_keys_total", "去重服务处理的 key 数", labels, nil),
+		hits:       prometheus.NewDesc("pando_bloom_hits_total", "命中的 key 数：contains 为已出现过，dedup 为重复", labels, nil),
+	}
+}
+
+func (c *bloomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.calls
+	ch <- c.keys
+	ch <- c.hits
+}
+
+func (c *bloomCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.namespaces.all() {
+		for op, counter := range map[string]*callCounter{
+			"add":      &m.stats.add,
+			"contains": &m.stats.contains,
+			"dedup":    &m.stats.dedup,
+		} {
+			s := counter.stats()
+			ch <- prometheus.MustNewConstMetric(c.calls, prometheus.CounterValue, float64(s.Calls), m.config.Name, op)
+			ch <- prometheus.MustNewConstMetric(c.keys, prometheus.CounterValue, float64(s.Keys), m.config.Name, op)
+			ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits), m.config.Name, op)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 增量复制：每个实例定时从所有对端拉取上次拉取之后对端本地写入过的桶，按位或合并到本地同一时间的桶。
+// 合并进来的数据不会再转发，因此对端列表需要两两互相配置（全互联）。
+//
+// 增量以整个桶为单位：只要桶在上次拉取之后有过写入，就发送这个桶的全部层。默认配置下一个桶约 90MB
+// （5000 万条、误判率 0.1%），持续写入时每次拉取至少包含当前桶，每对实例每个间隔传输约 90MB；
+// 按位或按字记录改动在写入高峰时几乎所有字都会被改到，省不了多少。因此默认每 5 分钟拉取一次
+// （每对实例约 0.3MB/s），代价是一个实例的写入最多延迟一个间隔才对其他实例可见。实际传输量见
+// pando_replication_bytes_total；缩短间隔前按对端数和桶大小估算带宽。
+//
+// 增量格式：magic + version + replicationHeader，之后每个桶
+// shard(uint32) timestamp(int64) kind(uint8) 扩容层数(uint8)，之后每层 m(uint64) k(uint64) size(int64) crc32(uint32) data，
+// 以 shard=replicationEnd 结束。
+//
+// 增量接口只接受带有共享令牌（replication.token）的请求，同时处理的请求数不超过对端数，超过时返回 429，对端下个间隔再拉取
+const (
+	ReplicationInterval = 5 * time.Minute // 默认拉取间隔，见上面的传输量估算
+
+	replicationTokenHeader = "X-Replication-Token"
+
+	replicationMagic   = "PBLR"
+	replicationVersion = 1
+	replicationEnd     = ^uint32(0)
+)
+
+// replicationHeader 增量的文件头
+type replicationHeader struct {
+	BucketSeconds int64
+	Shards        uint32
+	ServerTime    int64 // 对端开始编码时的 Unix 纳秒时间，下次从这里继续拉取
+}
+
+// ReplicationConfig 复制配置，是 Config 的 replication 部分
+type ReplicationConfig struct {
+	Peers    []string `json:"peers"`    // 对端地址，如 "http://10.0.0.2:8080"
+	Interval Duration `json:"interval"` // 拉取间隔，默认 ReplicationInterval
+	Token    string   `json:"token"`    // 对端之间共享的令牌，拉取时放在 X-Replication-Token 中；为空时不提供增量接口
+}
+
+// encodedBucket 编码后的桶，锁外写出
+type encodedBucket struct {
+	shard     uint32
+	timestamp int64
+	kind      uint8
+	layers    []encodedLayer
+}
+
+// writeDelta 写出本地写入时间晚于 since（Unix 纳秒）的桶；每个分片在锁内编码，锁外写出，慢的对端不会阻塞写入
+func (m *HourlyBloomManager) writeDelta(w io.Writer, since int64) error {
+	ew := &errWriter{w: w}
+	ew.writeBytes([]byte(replicationMagic))
+	ew.write(uint32(replicationVersion))
+	ew.write(replicationHeader{
+		BucketSeconds: int64(m.config.Bucket.Duration() / time.Second),
+		Shards:        uint32(len(m.shards)),
+		ServerTime:    time.Now().UnixNano(),
+	})
+
+	for i, shard := range m.shards {
+		var buckets []encodedBucket
+		<-shard.mtx
+		for _, f := range shard.filters {
+			if f == nil || f.Modified <= since {
+				continue
+			}
+			layers, err := f.encodeLayers()
+			if err != nil {
+				shard.mtx <- struct{}{}
+				return err
+			}
+			buckets = append(buckets, encodedBucket{
+				shard:     uint32(i),
+				timestamp: f.Timestamp,
+				kind:      f.kind(),
+				layers:    layers,
+			})
+		}
+		shard.mtx <- struct{}{}
+
+		for _, b := range buckets {
+			ew.write(b.shard)
+			ew.write(b.timestamp)
+			ew.write(b.kind)
+			ew.write(uint8(len(b.layers) - 1))
+			ew.writeLayers(b.layers)
+		}
+		if ew.err != nil {
+			return ew.err
+		}
+	}
+	ew.write(replicationEnd)
+	return ew.err
+}
+
+// mergeDelta 读取对端的增量并合并到本地，返回对端时间和合并的桶数；窗口外的桶直接跳过
+func (m *HourlyBloomManager) mergeDelta(r io.Reader) (int64, int, error) {
+	reader := bufio.NewReaderSize(r, 1<<20)
+
+	magic := make([]byte, len(replicationMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return 0, 0, err
+	}
+	var version uint32
+	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+		return 0, 0, err
+	}
+	if string(magic) != replicationMagic || version != replicationVersion {
+		return 0, 0, fmt.Errorf("不支持的增量格式: %q v%d", magic, version)
+	}
+	var header replicationHeader
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return 0, 0, err
+	}
+	bucketSeconds := int64(m.config.Bucket.Duration() / time.Second)
+	if header.BucketSeconds != bucketSeconds || int(header.Shards) != len(m.shards) {
+		return 0, 0, fmt.Errorf("对端几何参数不一致: 桶粒度 %ds 分片 %d, 本地 %ds 分片 %d",
+			header.BucketSeconds, header.Shards, bucketSeconds, len(m.shards))
+	}
+
+	merged := 0
+	for {
+		var shard uint32
+		if err := binary.Read(reader, binary.BigEndian, &shard); err != nil {
+			return 0, merged, err
+		}
+		if shard == replicationEnd {
+			return header.ServerTime, merged, nil
+		}
+
+		var b struct {
+			Timestamp int64
+			Kind      uint8
+			Extra     uint8
+		}
+		if err := binary.Read(reader, binary.BigEndian, &b); err != nil {
+			return 0, merged, err
+		}
+		layers := make([]encodedLayer, 0, int(b.Extra)+1)
+		for j := 0; j <= int(b.Extra); j++ {
+			kind := b.Kind
+			if j > 0 {
+				kind = filterKindBloom
+			}
+			layer, ok, err := readLayer(reader, false, kind)
+			if err != nil {
+				return 0, merged, fmt.Errorf("分片 %d: %w", shard, err)
+			}
+			if !ok {
+				return 0, merged, fmt.Errorf("分片 %d 桶 %d 校验失败", shard, b.Timestamp)
+			}
+			layers = append(layers, layer)
+		}
+		remote, err := decodeLayers(b.Kind, layers, 0, b.Timestamp, true)
+		if err != nil {
+			return 0, merged, fmt.Errorf("分片 %d 桶 %d: %w", shard, b.Timestamp, err)
+		}
+
+		err = m.Merge(int(shard), remote)
+		if errors.Is(err, ErrOutsideWindow) {
+			continue
+		}
+		if err != nil {
+			return 0, merged, err
+		}
+		merged++
+	}
+}
+
+// Merge 把远端分片 shard 中的一个桶按位或（计数布隆过滤器按计数器取最大值）合并到本地起始时间相同的桶，
+// 本地没有时新建；两边的分片数和过滤器类型必须一致，容量不同的布隆过滤器层单独保存，只用于查询。删除不会被复制
+func (m *HourlyBloomManager) Merge(shard int, remote *BloomFilterWithTime) error {
+	if shard < 0 || shard >= len(m.shards) {
+		return fmt.Errorf("分片 %d 不存在，本地共 %d 个分片", shard, len(m.shards))
+	}
+	s := m.shards[shard]
+	<-s.mtx
+	defer func() { s.mtx <- struct{}{} }()
+
+	skipped, err := s.merge(remote)
+	if skipped > 0 {
+		m.logger().Warn("桶的远端层数已满，跳过对端的层",
+			"shard", shard, "bucket", time.Unix(remote.Timestamp, 0).Format("2006-01-02 15:04"), "skipped", skipped)
+	}
+	return err
+}
+
+// Replicator 定时从对端拉取增量
+type Replicator struct {
+	namespaces *BloomNamespaces
+	config     ReplicationConfig
+	client     *http.Client
+	since      map[string]int64 // 对端地址 + 命名空间 -> 上次拉取到的对端时间
+}
+
+func NewReplicator(namespaces *BloomNamespaces, config ReplicationConfig) *Replicator {
+	return &Replicator{
+		namespaces: namespaces,
+		config:     config,
+		client:     &http.Client{Timeout: 5 * time.Minute},
+		since:      make(map[string]int64),
+	}
+}
+
+// Start 按配置的间隔定时同步
+func (r *Replicator) Start() {
+	slog.Info("启动复制", "peers", r.config.Peers, "interval", r.config.Interval.Duration())
+	go func() {
+		ticker := time.NewTicker(r.config.Interval.Duration())
+		for range ticker.C {
+			r.Sync()
+		}
+	}()
+}
+
+// Sync 从所有对端拉取所有命名空间的增量
+func (r *Replicator) Sync() {
+	for _, m := range r.namespaces.all() {
+		for _, peer := range r.config.Peers {
+			merged, err := r.pull(peer, m)
+			if err != nil {
+				m.logger().Warn("复制失败", "peer", peer, "error", err)
+				continue
+			}
+			if merged > 0 {
+				m.logger().Info("合并远端的桶", "peer", peer, "buckets", merged)
+			}
+		}
+	}
+}
+
+// pull 拉取一个对端的一个命名空间，对端没有该命名空间时跳过
+func (r *Replicator) pull(peer string, m *HourlyBloomManager) (int, error) {
+	key := peer + "/" + m.config.Name
+	query := url.Values{
+		"namespace": {m.config.Name},
+		"since":     {strconv.FormatInt(r.since[key], 10)},
+	}
+	req, err := http.NewRequest(http.MethodGet, peer+"/replication/buckets?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(replicationTokenHeader, r.config.Token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	body := &countingReader{r: resp.Body}
+	serverTime, merged, err := m.mergeDelta(body)
+	replicationBytes.WithLabelValues(m.config.Name, peer).Add(float64(body.n))
+	if err != nil {
+		return merged, err
+	}
+	r.since[key] = serverTime
+	return merged, nil
+}
+
+// countingReader 记录读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
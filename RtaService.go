@@ -10,7 +10,7 @@ import (
 	"github.com/satori/go.uuid"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
@@ -23,11 +23,6 @@ import (
 
 // 常量定义
 const (
-	RTA_ZHIKE_AK  = "252433141ffaa954195e5d9aca6f72de"
-	RTA_VIKING_AK = "00a3c4d5e32932a69d134e8e4c6c9d88"
-	RTA_ZHIKE_SK  = "7a9ffe698e61d04f7fc80dfc8ded52a8"
-	RTA_VIKING_SK = "2635e0b04e7483478f43b259b62689d9"
-
 	RTA_ZHIKE_NETWORK_URL    = "https://growth-rta.byteintl.com/api/v1/rta/network"
 	RTA_ZHIKE_NETWORK_URL_US = "https://growth-rta.tiktokv-us.com/api/v1/rta/network"
 	RTA_ZHIKE_REPORT_URL     = "https://growth-rta.byteintl.com/api/v1/rta/report"
@@ -285,6 +280,7 @@ type RTAReportData struct {
 }
 
 type RtaService struct {
+	config               RtaConfig
 	zhikeRtaIdMap        map[string]string
 	zhikeRtaIdMapForLite map[string]string
 	zhikeAppIdMap        map[string]string
@@ -299,8 +295,9 @@ type RtaService struct {
 	resolutions          []string
 }
 
-func NewRtaService() *RtaService {
+func NewRtaService(config RtaConfig) *RtaService {
 	service := &RtaService{
+		config: config,
 		zhikeRtaIdMap: map[string]string{
 			"ID": "1", "TH": "2", "BR": "3", "MX": "4", "VN": "5",
 			"CA": "6", "MY": "7", "CL": "8", "US": "9", "GB": "11",
@@ -439,7 +436,7 @@ func (s *RtaService) loadTimeZoneData() {
 	// 读取当前目录下geos.json文件
 	file, err := os.Open("geos.json")
 	if err != nil {
-		fmt.Printf("无法打开文件: %v\n", err)
+		slog.Error("无法打开时区文件", "error", err)
 		return
 	}
 	defer file.Close()
@@ -481,18 +478,18 @@ func (s *RtaService) sign(ak string, sk string, requestTimestamp int64, body []b
 }
 
 func (s *RtaService) checkRtaZhike(rtaReuestData *RTAReqData) bool {
-	return s.checkRtaTT(rtaReuestData, RTA_ZHIKE_AK, RTA_ZHIKE_SK, RTA_ZHIKE_NETWORK_URL, RTA_ZHIKE_REPORT_URL)
+	return s.checkRtaTT(rtaReuestData, s.config.ZhikeAK, s.config.ZhikeSK, RTA_ZHIKE_NETWORK_URL, RTA_ZHIKE_REPORT_URL)
 }
 
 func (s *RtaService) checkRtaViking(rtaReuestData *RTAReqData) bool {
-	return s.checkRtaTT(rtaReuestData, RTA_VIKING_AK, RTA_VIKING_SK, RTA_VIKING_NETWORK_URL, RTA_VIKING_REPORT_URL)
+	return s.checkRtaTT(rtaReuestData, s.config.VikingAK, s.config.VikingSK, RTA_VIKING_NETWORK_URL, RTA_VIKING_REPORT_URL)
 }
 
 func (s *RtaService) passRtaZhikeDdj(ddjData []*OfferUserDataBase, offers *Offers) []*OfferUserDataBase {
-	return s.passRtaDdj(ddjData, offers, RTA_ZHIKE_AK, RTA_ZHIKE_SK, RTA_ZHIKE_NETWORK_URL, RTA_ZHIKE_REPORT_URL)
+	return s.passRtaDdj(ddjData, offers, s.config.ZhikeAK, s.config.ZhikeSK, RTA_ZHIKE_NETWORK_URL, RTA_ZHIKE_REPORT_URL)
 }
 func (s *RtaService) passRtaVikingDdj(ddjData []*OfferUserDataBase, offers *Offers) []*OfferUserDataBase {
-	return s.passRtaDdj(ddjData, offers, RTA_VIKING_AK, RTA_VIKING_SK, RTA_VIKING_NETWORK_URL, RTA_VIKING_REPORT_URL)
+	return s.passRtaDdj(ddjData, offers, s.config.VikingAK, s.config.VikingSK, RTA_VIKING_NETWORK_URL, RTA_VIKING_REPORT_URL)
 }
 
 func (s *RtaService) checkRtaTT(rtaReqData *RTAReqData, ak, sk, networkUrl, reportUrl string) bool {
@@ -644,7 +641,7 @@ func (s *RtaService) checkRtaTT(rtaReqData *RTAReqData, ak, sk, networkUrl, repo
 	if resp != nil && resp.StatusCode == http.StatusOK {
 		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		fmt.Println("Response:", string(body))
+		slog.Debug("RTA 响应", "url", networkUrl, "country", rtaReqData.Country, "package", rtaReqData.PackageName, "body", string(body))
 
 		var resp *TiktokRtaResp
 
@@ -667,14 +664,22 @@ func (s *RtaService) checkRtaTT(rtaReqData *RTAReqData, ak, sk, networkUrl, repo
 						}
 
 						s.reportRta(rtaReportData, ak, sk, reportUrl)
+						rtaChecks.WithLabelValues("pass").Inc()
 						return true
 					}
 				}
 			}
 		}
 	} else {
-		fmt.Println("Error:", err)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		slog.Warn("RTA 请求失败", "url", networkUrl, "country", rtaReqData.Country, "status", status, "error", err)
+		rtaChecks.WithLabelValues("error").Inc()
+		return false
 	}
+	rtaChecks.WithLabelValues("reject").Inc()
 	return false
 }
 
@@ -726,7 +731,7 @@ func (s *RtaService) reportRta(rtaReportData *RTAReportData, ak string, sk strin
 
 	_, err := s.sendRequest(reportUrl, paramMap, headerMap)
 	if err != nil {
-		log.Printf("report rta error: %v", err)
+		slog.Warn("RTA 上报失败", "url", reportUrl, "app_id", rtaReportData.AppId, "error", err)
 	}
 }
 
@@ -822,7 +827,7 @@ func (s *RtaService) passRtaDdj(ddjData []*OfferUserDataBase, offers *Offers, ak
 		case <-done:
 			// 正常完成
 		case <-time.After(50 * time.Second):
-			log.Printf("处理批次超时，已取消")
+			slog.Warn("RTA 批次超时，已取消", "offer_id", offers.OfferId, "batch", end-i)
 		}
 	}
 
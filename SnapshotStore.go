@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tencentyun/cos-go-sdk-v5"
+)
+
+const (
+	SnapshotCosRegion   = RegionSG // 快照存放的 COS 桶
+	snapshotCosPrefix   = "bloom-snapshot/"
+	snapshotRedisPrefix = "bloom:snapshot:"
+	redisChunkSize      = 64 << 20 // Redis 单个 value 上限 512MB，快照按 64MB 分块存放
+)
+
+// SnapshotStore 快照存储。快照按名称（状态文件名）存取，新实例可以从共享存储拉取最新快照启动
+type SnapshotStore interface {
+	// Save 调用 write 写入完整的快照，全部写入成功后才替换旧快照
+	Save(name string, write func(w io.Writer) error) error
+	// Open 打开最新的快照，不存在时返回的错误满足 os.IsNotExist
+	Open(name string) (io.ReadCloser, error)
+	String() string
+}
+
+// newSnapshotStore 按名称创建快照存储：local（写在 dir 下）、cos、redis。cos 和 redis 需要先调用 InitClients
+func newSnapshotStore(backend, dir string) (SnapshotStore, error) {
+	switch backend {
+	case "", "local":
+		return NewLocalSnapshotStore(dir), nil
+	case "cos":
+		client := CosClients[SnapshotCosRegion]
+		if client == nil {
+			return nil, fmt.Errorf("COS 客户端未初始化: %s", SnapshotCosRegion)
+		}
+		return NewCosSnapshotStore(client, snapshotCosPrefix), nil
+	case "redis":
+		if RedisClient == nil {
+			return nil, errors.New("Redis 客户端未初始化")
+		}
+		return NewRedisSnapshotStore(RedisClient, snapshotRedisPrefix), nil
+	default:
+		return nil, fmt.Errorf("不支持的快照存储: %q", backend)
+	}
+}
+
+// LocalSnapshotStore 本地磁盘：先写临时文件并 fsync，再原子地 rename 覆盖，崩溃时不会留下半个文件
+type LocalSnapshotStore struct {
+	dir string
+}
+
+func NewLocalSnapshotStore(dir string) *LocalSnapshotStore {
+	return &LocalSnapshotStore{dir: dir}
+}
+
+func (s *LocalSnapshotStore) String() string {
+	return "local:" + s.dir
+}
+
+func (s *LocalSnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	path := filepath.Join(s.dir, name)
+	tmp, err := os.CreateTemp(s.dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // rename 成功后是空操作
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("写入临时文件失败: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// rename 本身也要落盘
+	if d, err := os.Open(s.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// removeStaleTemp 删除 dir 下 Save 留下的临时文件。进程在写入过程中被杀掉时 defer 不会执行，临时文件会一直留在磁盘上；
+// 只能在持有状态文件锁、没有其他写入时调用
+func removeStaleTemp(dir string) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+	if err != nil {
+		return
+	}
+	for _, path := range matches {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("删除残留的临时文件失败", "path", path, "error", err)
+			continue
+		}
+		slog.Info("已删除残留的临时文件", "path", path)
+	}
+}
+
+func (s *LocalSnapshotStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+// CosSnapshotStore 腾讯云 COS：先写本地临时文件，再分块上传覆盖对象，对象要么是旧快照要么是新快照
+type CosSnapshotStore struct {
+	client *cos.Client
+	prefix string
+}
+
+func NewCosSnapshotStore(client *cos.Client, prefix string) *CosSnapshotStore {
+	return &CosSnapshotStore{client: client, prefix: prefix}
+}
+
+func (s *CosSnapshotStore) String() string {
+	return "cos:" + s.client.BaseURL.BucketURL.Host + "/" + s.prefix
+}
+
+func (s *CosSnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp("", name+".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("写入临时文件失败: %w", err)
+	}
+
+	if _, _, err := s.client.Object.Upload(ctx, s.prefix+name, tmp.Name(), nil); err != nil {
+		return fmt.Errorf("上传快照失败: %w", err)
+	}
+	return nil
+}
+
+func (s *CosSnapshotStore) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.client.Object.Get(ctx, s.prefix+name, nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return nil, fmt.Errorf("%s%s: %w", s.prefix, name, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// RedisSnapshotStore Redis：快照分块写入 <prefix><name>:<代>:<序号>，全部写完后再更新清单 <prefix><name>，
+// 读取时按清单拉取，旧的一代在清单更新后删除
+type RedisSnapshotStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisSnapshotManifest 快照清单
+type redisSnapshotManifest struct {
+	Generation int64 `json:"generation"`
+	Chunks     int   `json:"chunks"`
+	Size       int64 `json:"size"`
+}
+
+func NewRedisSnapshotStore(client *redis.Client, prefix string) *RedisSnapshotStore {
+	return &RedisSnapshotStore{client: client, prefix: prefix}
+}
+
+func (s *RedisSnapshotStore) String() string {
+	return "redis:" + s.client.Options().Addr + "/" + s.prefix
+}
+
+func (s *RedisSnapshotStore) chunkKey(name string, generation int64, i int) string {
+	return s.prefix + name + ":" + strconv.FormatInt(generation, 10) + ":" + strconv.Itoa(i)
+}
+
+func (s *RedisSnapshotStore) manifest(name string) (*redisSnapshotManifest, error) {
+	data, err := s.client.Get(ctx, s.prefix+name).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%s%s: %w", s.prefix, name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest redisSnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("快照清单损坏: %w", err)
+	}
+	return &manifest, nil
+}
+
+// deleteChunks 删除一代快照的所有分块
+func (s *RedisSnapshotStore) deleteChunks(name string, generation int64, chunks int) {
+	for i := 0; i < chunks; i++ {
+		s.client.Del(ctx, s.chunkKey(name, generation, i))
+	}
+}
+
+func (s *RedisSnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	old, err := s.manifest(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	w := &redisChunkWriter{store: s, name: name, generation: time.Now().UnixNano()}
+	err = write(w)
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		s.deleteChunks(name, w.generation, w.chunks+1)
+		return err
+	}
+
+	data, _ := json.Marshal(redisSnapshotManifest{Generation: w.generation, Chunks: w.chunks, Size: w.size})
+	if err := s.client.Set(ctx, s.prefix+name, data, 0).Err(); err != nil {
+		s.deleteChunks(name, w.generation, w.chunks)
+		return err
+	}
+	if old != nil && old.Generation != w.generation {
+		s.deleteChunks(name, old.Generation, old.Chunks)
+	}
+	return nil
+}
+
+func (s *RedisSnapshotStore) Open(name string) (io.ReadCloser, error) {
+	manifest, err := s.manifest(name)
+	if err != nil {
+		return nil, err
+	}
+	return &redisChunkReader{store: s, name: name, manifest: manifest}, nil
+}
+
+// redisChunkWriter 把写入按 redisChunkSize 切块后依次 SET
+type redisChunkWriter struct {
+	store      *RedisSnapshotStore
+	name       string
+	generation int64
+	buf        bytes.Buffer
+	chunks     int
+	size       int64
+}
+
+func (w *redisChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := redisChunkSize - w.buf.Len()
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf.Write(p[:room])
+		p = p[room:]
+		if w.buf.Len() == redisChunkSize {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *redisChunkWriter) flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	key := w.store.chunkKey(w.name, w.generation, w.chunks)
+	if err := w.store.client.Set(ctx, key, w.buf.Bytes(), 0).Err(); err != nil {
+		return err
+	}
+	w.size += int64(w.buf.Len())
+	w.chunks++
+	w.buf.Reset()
+	return nil
+}
+
+// redisChunkReader 按清单依次读取分块
+type redisChunkReader struct {
+	store    *RedisSnapshotStore
+	name     string
+	manifest *redisSnapshotManifest
+	next     int
+	current  *bytes.Reader
+}
+
+func (r *redisChunkReader) Read(p []byte) (int, error) {
+	for r.current == nil || r.current.Len() == 0 {
+		if r.next >= r.manifest.Chunks {
+			return 0, io.EOF
+		}
+		key := r.store.chunkKey(r.name, r.manifest.Generation, r.next)
+		data, err := r.store.client.Get(ctx, key).Bytes()
+		if err != nil {
+			return 0, fmt.Errorf("读取快照分块 %s 失败: %w", key, err)
+		}
+		r.current = bytes.NewReader(data)
+		r.next++
+	}
+	return r.current.Read(p)
+}
+
+func (r *redisChunkReader) Close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrStateLocked 状态文件正被另一个进程使用
+var ErrStateLocked = errors.New("state file is locked by another process")
+
+// 服务和写入布隆过滤器的 backfill 都会写状态文件、轮转预写日志，同一时间只能有一个进程使用同一个状态文件。
+// 使用者在状态文件旁边的 .lock 文件上持有排他锁（unix 上为 flock，Windows 上为 LockFileEx），进程退出时自动释放
+
+// stateLockPath 状态文件的锁文件
+func stateLockPath(statePath string) string {
+	return statePath + ".lock"
+}
+
+// lockState 以非阻塞方式获取状态文件的排他锁，已被其他进程持有时返回 ErrStateLocked；关闭返回的文件即释放锁。
+// 获取锁后删除上次崩溃时留在状态文件目录下的临时文件
+func lockState(statePath string) (*os.File, error) {
+	file, err := os.OpenFile(stateLockPath(statePath), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, fmt.Errorf("%w: %s", ErrStateLocked, statePath)
+		}
+		return nil, err
+	}
+	removeStaleTemp(filepath.Dir(statePath))
+	return file, nil
+}
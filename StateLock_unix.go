@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// errWouldBlock 锁已被其他进程持有
+const errWouldBlock = syscall.EWOULDBLOCK
+
+// lockFile 以非阻塞方式获取文件的排他 flock
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -2,242 +2,471 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
-	"io"
-	"log"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/cespare/xxhash/v2"
 	"github.com/gin-gonic/gin"
 )
 
+// 默认参数，是 DefaultConfig 的默认值，运行时以 LoadConfig 加载的配置为准
 const (
-	HourlyCount   = 50_000_000 // 每小时最多 5000 万条
-	FalsePositive = 0.001      // 误判率 0.1%
-	NumHours      = 24         // 保留 24 小时
-	StateFilePath = "./bloom_state.bin"
-	HTTPPort      = ":8080"
+	HourlyCount     = 50_000_000 // 每小时最多 5000 万条
+	FalsePositive   = 0.001      // 误判率 0.1%
+	NumHours        = 24         // 保留 24 小时
+	BucketDuration  = time.Hour  // 默认每个桶 1 小时
+	StateFilePath   = "./bloom_state.bin"
+	SnapshotBackend = "local" // 快照存储：local、cos、redis
+	HTTPPort        = ":8080"
+	LogLevel        = "info"        // 日志级别：debug、info、warn、error
+	LogFormat       = LogFormatJSON // 日志格式：json、text
 )
 
 // BloomFilterWithTime 包含时间戳的布隆过滤器
 type BloomFilterWithTime struct {
 	BF        *bloom.BloomFilter
-	Timestamp int64 // 小时级 Unix 时间（UTC）
+	Layers    []*bloom.BloomFilter // BF 写满后追加的扩容层，新数据写入最后一层
+	Remote    []*bloom.BloomFilter // 从对端合并来、与本地各层 m/k 都不同的层，只用于查询，不写入也不转发
+	CBF       *CountingBloomFilter // counting 后端的命名空间使用，此时 BF 为 nil
+	Timestamp int64                // 桶起始 Unix 时间（UTC），按桶粒度对齐
+	Modified  int64                // 本地最后一次写入的 Unix 纳秒时间，用于增量复制，不持久化
+
+	added   uint // 最后一层自上次估算误判率以来的写入次数
+	checkAt uint // added 达到该值时再次估算
+
+	observed bool // 基数已经记入分片的历史，重启后从恢复的桶重建历史时避免淘汰时重复记录
 }
 
-// HourlyBloomManager 管理 24 个每小时的布隆过滤器
+// HourlyBloomManager 管理一个命名空间下按时间分桶的布隆过滤器（默认 24 个 1 小时的桶）。
+// 数据按 key 的哈希分到多个分片，每个分片有独立的桶环和锁，读写互不阻塞
 type HourlyBloomManager struct {
-	filters [NumHours]*BloomFilterWithTime
-	current int           // 当前写入的索引
-	mtx     chan struct{} // 轻量级互斥锁（用带缓冲 channel 实现）
+	config    NamespaceConfig
+	statePath string        // 本地状态文件，预写日志放在旁边
+	store     SnapshotStore // 快照存储，快照名为状态文件名
+	shards    []*bloomShard
+	wal       *bloomWAL  // 为 nil 时不写预写日志
+	exact     *exactTier // 为 nil 时只用布隆过滤器
+	stats     managerStats
+
+	// counting 后端的写入重复回放会重复计数：写入在修改和写日志期间持有读锁，快照在封存日志和编码期间持有写锁，
+	// 每条写入要么在快照中、要么在封存之后的日志中，不会同时出现在两处
+	writeMtx sync.RWMutex
 }
 
+// NewHourlyBloomManager 创建默认命名空间的管理器
 func NewHourlyBloomManager() *HourlyBloomManager {
+	return newHourlyBloomManager(DefaultNamespaceConfig(), StateFilePath)
+}
+
+// newHourlyBloomManager 按命名空间配置创建管理器，并尝试从本地的 statePath 恢复
+func newHourlyBloomManager(config NamespaceConfig, statePath string) *HourlyBloomManager {
+	return newHourlyBloomManagerWithStore(config, statePath, NewLocalSnapshotStore(filepath.Dir(statePath)))
+}
+
+// newHourlyBloomManagerWithStore 同 newHourlyBloomManager，快照从 store 读写
+func newHourlyBloomManagerWithStore(config NamespaceConfig, statePath string, store SnapshotStore) *HourlyBloomManager {
+	m := loadHourlyBloomManager(config, statePath, store)
+	m.startWAL()
+	return m
+}
+
+// newReadOnlyManager 加载快照并回放预写日志，不截断也不打开预写日志，可以和正在使用同一状态文件的服务同时运行。
+// 返回的管理器不应写入，写入不会被记录，也不应保存
+func newReadOnlyManager(config NamespaceConfig, statePath string, store SnapshotStore) *HourlyBloomManager {
+	m := loadHourlyBloomManager(config, statePath, store)
+	if config.WALSync != WALSyncDisabled {
+		if err := m.replayLog(false); err != nil {
+			m.logger().Warn("回放预写日志失败，只依赖快照", "error", err)
+		}
+	}
+	return m
+}
+
+// loadHourlyBloomManager 从快照加载，没有可用的快照时创建新的桶
+func loadHourlyBloomManager(config NamespaceConfig, statePath string, store SnapshotStore) *HourlyBloomManager {
 	m := &HourlyBloomManager{
-		filters: [NumHours]*BloomFilterWithTime{},
-		current: -1,
-		mtx:     make(chan struct{}, 1),
+		config:    config,
+		statePath: statePath,
+		store:     store,
 	}
-	m.mtx <- struct{}{} // 初始化锁
+	m.initShards(config.NumShards())
 
 	// 尝试从磁盘加载
 	if err := m.loadFromDisk(); err != nil {
-		log.Printf("首次启动或加载失败，创建新的布隆过滤器: %v", err)
-		m.initNew()
+		m.logger().Info("首次启动或加载失败，创建新的布隆过滤器", "error", err)
+		for _, shard := range m.shards {
+			shard.initNew()
+		}
 	} else {
-		log.Printf("成功从磁盘加载状态")
-		m.alignToCurrentHour()
+		m.logger().Info("成功从磁盘加载状态")
+		m.recoverBuckets()
 	}
 	return m
 }
 
-// initNew 初始化 24 个新的布隆过滤器
-func (m *HourlyBloomManager) initNew() {
-	now := time.Now()
-	hourStart := now.Truncate(time.Hour).Unix()
-
-	for i := 0; i < NumHours; i++ {
-		ts := hourStart - int64((NumHours-1-i))*3600
-		m.filters[i] = &BloomFilterWithTime{
-			BF:        bloom.NewWithEstimates(uint(HourlyCount), FalsePositive),
-			Timestamp: ts,
-		}
+// initShards 创建 n 个空分片，每个桶的容量平均分到各分片
+func (m *HourlyBloomManager) initShards(n int) {
+	m.config.Shards = n
+	capacity := (m.config.Capacity + uint(n) - 1) / uint(n)
+	m.shards = make([]*bloomShard, n)
+	for i := range m.shards {
+		m.shards[i] = newBloomShard(i, &m.config, capacity)
 	}
-	m.current = NumHours - 1 // 最后一个是当前小时
 }
 
-// alignToCurrentHour 对齐到当前小时，清理过期数据
-func (m *HourlyBloomManager) alignToCurrentHour() {
-	now := time.Now()
-	currentHour := now.Truncate(time.Hour).Unix()
+// Config 返回命名空间配置
+func (m *HourlyBloomManager) Config() NamespaceConfig {
+	return m.config
+}
 
-	// 找到当前小时对应的索引
-	found := false
-	for i := 0; i < NumHours; i++ {
-		if m.filters[i] != nil && m.filters[i].Timestamp == currentHour {
-			m.current = i
-			found = true
-			break
+// shard 返回 key 所在的分片
+func (m *HourlyBloomManager) shard(key string) *bloomShard {
+	return m.shards[xxhash.Sum64String(key)%uint64(len(m.shards))]
+}
+
+// recoverBuckets 加载后对齐到当前时间，保留仍在窗口内的桶，并输出恢复报告
+func (m *HourlyBloomManager) recoverBuckets() {
+	restored := make(map[int64]bool)
+	dropped := make(map[int64]bool)
+	missing := make(map[int64]bool)
+	for _, shard := range m.shards {
+		r, d, miss := shard.recoverBuckets()
+		for _, ts := range r {
+			restored[ts] = true
+		}
+		for _, ts := range d {
+			dropped[ts] = true
+		}
+		for _, ts := range miss {
+			missing[ts] = true
 		}
 	}
 
-	if !found {
-		// 时间偏差太大，重新初始化
-		log.Printf("时间偏差过大，重新初始化")
-		m.initNew()
-	}
+	bucketSeconds := int64(m.config.Bucket.Duration() / time.Second)
+	m.logger().Info("恢复报告",
+		"restored", formatBuckets(restored, bucketSeconds),
+		"dropped", formatBuckets(dropped, bucketSeconds),
+		"missing", formatBuckets(missing, bucketSeconds))
 }
 
-// getCurrentHourIndex 获取当前应写入的索引（基于时间）
-func (m *HourlyBloomManager) getCurrentHourIndex() int {
-	<-m.mtx
-	defer func() { m.mtx <- struct{}{} }()
-
-	now := time.Now()
-	currentHour := now.Truncate(time.Hour).Unix()
-
-	// 检查是否需要滚动
-	if m.current == -1 || m.filters[m.current].Timestamp != currentHour {
-		// 滚动到下一小时
-		m.current = (m.current + 1) % NumHours
-		m.filters[m.current] = &BloomFilterWithTime{
-			BF:        bloom.NewWithEstimates(uint(HourlyCount), FalsePositive),
-			Timestamp: currentHour,
+// formatBuckets 把桶起始时间排序并格式化，连续的桶合并成 "起~止"，用于日志
+func formatBuckets(buckets map[int64]bool, bucketSeconds int64) []string {
+	timestamps := make([]int64, 0, len(buckets))
+	for ts := range buckets {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	format := func(ts int64) string { return time.Unix(ts, 0).Format("2006-01-02 15:04") }
+	var ranges []string
+	for i := 0; i < len(timestamps); {
+		j := i
+		for j+1 < len(timestamps) && timestamps[j+1]-timestamps[j] == bucketSeconds {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, format(timestamps[i]))
+		} else {
+			ranges = append(ranges, format(timestamps[i])+"~"+format(timestamps[j]))
 		}
-		log.Printf("滚动到新小时: %s", time.Unix(currentHour, 0).Format("2006-01-02 15:00"))
+		i = j + 1
 	}
-
-	return m.current
+	return ranges
 }
 
-// Add 添加字符串 返回插入的索引
+// Add 添加字符串 返回插入的索引（分片内的桶索引）
 func (m *HourlyBloomManager) Add(s string) int {
-	idx := m.getCurrentHourIndex()
-	m.filters[idx].BF.AddString(s)
+	defer m.lockWrites()()
+	shard := m.shard(s)
+	<-shard.mtx
+	idx := shard.add(s)
+	ts := shard.filters[idx].Timestamp
+	shard.mtx <- struct{}{}
+
+	m.stats.add.record(1, 0)
+	m.logWAL(walRecord{Timestamp: ts, Key: s})
+	m.writeExact([]string{s}, time.Now())
 	return idx
 }
 
-// Contains 检查是否在过去 24 小时内出现过
-func (m *HourlyBloomManager) Contains(s string) bool {
-	<-m.mtx
-	defer func() { m.mtx <- struct{}{} }()
+// TestAndAdd 原子地检查并写入：窗口内未出现过时写入当前桶并返回 true
+func (m *HourlyBloomManager) TestAndAdd(s string) bool {
+	defer m.lockWrites()()
+	if newOnes, ok := m.dedupExact([]string{s}); ok {
+		m.stats.dedup.record(1, 1-len(newOnes))
+		return len(newOnes) == 1
+	}
 
+	shard := m.shard(s)
+	<-shard.mtx
 	now := time.Now()
-	cutoff := now.Add(-24 * time.Hour).Truncate(time.Hour).Unix()
+	added := shard.testAndAdd(s, now.Add(-m.config.Window.Duration()), now)
+	ts := shard.filters[shard.current].Timestamp
+	shard.mtx <- struct{}{}
+
+	if added {
+		m.stats.dedup.record(1, 0)
+		m.logWAL(walRecord{Timestamp: ts, Key: s})
+		m.writeExact([]string{s}, now)
+	} else {
+		m.stats.dedup.record(1, 1)
+	}
+	return added
+}
 
-	for i := 0; i < NumHours; i++ {
-		f := m.filters[i]
-		if f != nil && f.Timestamp >= cutoff {
-			if f.BF.TestString(s) {
-				return true
-			}
-		}
+// ErrOutsideWindow 事件时间早于窗口或晚于当前桶
+var ErrOutsideWindow = errors.New("event time outside window")
+
+// AddAt 按事件时间把字符串写入对应的桶，用于回放和补数；早于窗口或晚于当前时间的会被拒绝
+func (m *HourlyBloomManager) AddAt(s string, t time.Time) (int, error) {
+	defer m.lockWrites()()
+	shard := m.shard(s)
+	<-shard.mtx
+	idx, err := shard.addAt(s, t)
+	var ts int64
+	if err == nil {
+		ts = shard.filters[idx].Timestamp
 	}
-	return false
+	shard.mtx <- struct{}{}
+
+	if err == nil {
+		m.stats.add.record(1, 0)
+		m.logWAL(walRecord{Timestamp: ts, Key: s})
+		m.writeExact([]string{s}, t)
+	}
+	return idx, err
 }
 
-// Dedup 接收一批字符串，返回其中未出现过的
-func (m *HourlyBloomManager) Dedup(strings []string) []string {
-	var newOnes []string
-	for _, s := range strings {
-		if !m.Contains(s) {
-			newOnes = append(newOnes, s)
-			m.Add(s)
+// TestAndAddAt 按事件时间原子地检查并写入：[t-窗口, 现在] 内未出现过时写入 t 所在的桶并返回 true，用于补齐和补数。
+// 早于窗口或晚于当前时间的会被拒绝；精确去重的命名空间优先用 Redis 判断
+func (m *HourlyBloomManager) TestAndAddAt(s string, t time.Time) (bool, error) {
+	defer m.lockWrites()()
+	if m.exact != nil {
+		if err := m.shard(s).checkWindow(t); err != nil {
+			return false, err
+		}
+		if isNew, ok := m.setNX([]string{s}, t); ok {
+			if !isNew[0] {
+				m.stats.dedup.record(1, 1)
+				return false, nil
+			}
+			shard := m.shard(s)
+			<-shard.mtx
+			idx, err := shard.addAt(s, t)
+			var ts int64
+			if err == nil {
+				ts = shard.filters[idx].Timestamp
+			}
+			shard.mtx <- struct{}{}
+
+			if err != nil {
+				return false, err // 检查之后窗口滚动
+			}
+			m.stats.dedup.record(1, 0)
+			m.logWAL(walRecord{Timestamp: ts, Key: s})
+			return true, nil
 		}
 	}
-	return newOnes
-}
 
-// SaveToDisk 持久化到磁盘
-func (m *HourlyBloomManager) SaveToDisk() error {
-	<-m.mtx
-	defer func() { m.mtx <- struct{}{} }()
+	shard := m.shard(s)
+	<-shard.mtx
+	idx, added, err := shard.testAndAddAt(s, t)
+	var ts int64
+	if added {
+		ts = shard.filters[idx].Timestamp
+	}
+	shard.mtx <- struct{}{}
 
-	file, err := os.Create(StateFilePath)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if added {
+		m.stats.dedup.record(1, 0)
+		m.logWAL(walRecord{Timestamp: ts, Key: s})
+		m.writeExact([]string{s}, t)
+	} else {
+		m.stats.dedup.record(1, 1)
 	}
-	defer file.Close()
+	return added, nil
+}
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+// Contains 检查是否在窗口（默认过去 24 小时）内出现过
+func (m *HourlyBloomManager) Contains(s string) bool {
+	return m.ContainsWithin(s, m.config.Window.Duration())
+}
 
-	for i := 0; i < NumHours; i++ {
-		f := m.filters[i]
-		if f == nil {
-			// 写入 nil 标记
-			binary.Write(writer, binary.BigEndian, int64(0))
-			continue
-		}
+// ContainsWithin 检查过去 lookback 时间内是否出现过，超出窗口的部分按窗口处理
+func (m *HourlyBloomManager) ContainsWithin(s string, lookback time.Duration) bool {
+	now := time.Now()
+	return m.ContainsBetween(s, now.Add(-lookback), now)
+}
 
-		// 写入时间戳
-		binary.Write(writer, binary.BigEndian, f.Timestamp)
+// ContainsBetween 只检查起始时间落在 [since, until] 所在桶之间的桶
+func (m *HourlyBloomManager) ContainsBetween(s string, since, until time.Time) bool {
+	shard := m.shard(s)
+	<-shard.mtx
+	_, ok := shard.firstMatch(s, since, until)
+	shard.mtx <- struct{}{}
 
-		// 写入位数组长度
-		bytes, _ := f.BF.GobEncode()
-		binary.Write(writer, binary.BigEndian, int64(len(bytes)))
-		writer.Write(bytes)
+	hits := 0
+	if ok {
+		hits = 1
 	}
+	m.stats.contains.record(1, hits)
+	return ok
+}
 
-	log.Printf("已持久化到磁盘: %s", StateFilePath)
-	return nil
+// CheckResult 批量查询的单条结果
+type CheckResult struct {
+	Key    string `json:"key"`
+	Seen   bool   `json:"seen"`
+	Bucket int64  `json:"bucket,omitempty"` // 首次命中的桶起始 Unix 时间
 }
 
-// loadFromDisk 从磁盘加载
-func (m *HourlyBloomManager) loadFromDisk() error {
-	file, err := os.Open(StateFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// ContainsBatch 批量检查窗口内是否出现过，不写入任何数据
+func (m *HourlyBloomManager) ContainsBatch(keys []string) []CheckResult {
+	now := time.Now()
+	return m.ContainsBatchBetween(keys, now.Add(-m.config.Window.Duration()), now)
+}
 
-	reader := bufio.NewReader(file)
+// ContainsBatchBetween 同 ContainsBatch，只检查 [since, until] 范围内的桶
+func (m *HourlyBloomManager) ContainsBatchBetween(keys []string, since, until time.Time) []CheckResult {
+	results := make([]CheckResult, len(keys))
+	hits := 0
+	m.forEachShard(keys, func(shard *bloomShard, i int) {
+		bucket, seen := shard.firstMatch(keys[i], since, until)
+		results[i] = CheckResult{Key: keys[i], Seen: seen, Bucket: bucket}
+		if seen {
+			hits++
+		}
+	})
+	m.stats.contains.record(len(keys), hits)
+	return results
+}
 
-	var filters [NumHours]*BloomFilterWithTime
+// Remove 从窗口内的所有桶中删除一批 key（如被 DDJ 拒绝或被 RTA 过滤掉的设备），使其可以再次通过去重，
+// 返回实际删除的个数。只有 counting 后端支持；只应删除确实写入过的 key，删除误判的 key 会让其他 key 漏判
+func (m *HourlyBloomManager) Remove(keys []string) (int, error) {
+	if m.config.Backend != BackendCounting {
+		return 0, ErrRemoveUnsupported
+	}
+	defer m.lockWrites()()
 
-	for i := 0; i < NumHours; i++ {
-		var timestamp int64
-		err := binary.Read(reader, binary.BigEndian, &timestamp)
+	if m.exact != nil && len(keys) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), exactTimeout)
+		err := m.exact.store.Remove(ctx, m.config.Name, keys)
+		cancel()
 		if err != nil {
-			return err
+			m.logger().Warn("从精确去重中删除失败", "error", err)
 		}
+		m.removePendingExact(keys)
+	}
 
-		if timestamp == 0 {
-			filters[i] = nil
-			continue
+	removed := 0
+	var records []walRecord
+	var firstErr error
+	m.forEachShard(keys, func(shard *bloomShard, i int) {
+		ok, err := shard.remove(keys[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
+		if ok {
+			removed++
+			records = append(records, walRecord{Timestamp: walRemove, Key: keys[i]})
+		}
+	})
+	m.logWAL(records...)
+	return removed, firstErr
+}
 
-		var size int64
-		err = binary.Read(reader, binary.BigEndian, &size)
-		if err != nil {
-			return err
+// Dedup 接收一批字符串，返回其中未出现过的；精确去重的命名空间优先用 Redis 判断，不可用时回退到布隆过滤器
+func (m *HourlyBloomManager) Dedup(strings []string) []string {
+	defer m.lockWrites()()
+	newOnes, ok := m.dedupExact(strings)
+	if !ok {
+		newOnes = m.dedupWithin(strings, m.config.Window.Duration())
+		m.writeExact(newOnes, time.Now())
+	}
+	m.stats.dedup.record(len(strings), len(strings)-len(newOnes))
+	return newOnes
+}
+
+// DedupWithin 同 Dedup，但只把过去 lookback 时间内出现过的视为重复，只使用布隆过滤器
+func (m *HourlyBloomManager) DedupWithin(strings []string, lookback time.Duration) []string {
+	defer m.lockWrites()()
+	newOnes := m.dedupWithin(strings, lookback)
+	m.stats.dedup.record(len(strings), len(strings)-len(newOnes))
+	return newOnes
+}
+
+// dedupWithin 每个分片在一次加锁内完成检查和写入，并发请求同一个 key 时只有一个会拿到它
+func (m *HourlyBloomManager) dedupWithin(strings []string, lookback time.Duration) []string {
+	now := time.Now()
+	since := now.Add(-lookback)
+	isNew := make([]bool, len(strings))
+	var records []walRecord
+	m.forEachShard(strings, func(shard *bloomShard, i int) {
+		isNew[i] = shard.testAndAdd(strings[i], since, now)
+		if isNew[i] {
+			records = append(records, walRecord{Timestamp: shard.filters[shard.current].Timestamp, Key: strings[i]})
 		}
+	})
+	m.logWAL(records...)
 
-		data := make([]byte, size)
-		_, err = io.ReadFull(reader, data)
-		if err != nil {
-			return err
+	var newOnes []string
+	for i, s := range strings {
+		if isNew[i] {
+			newOnes = append(newOnes, s)
 		}
+	}
+	return newOnes
+}
 
-		bf := bloom.NewWithEstimates(uint(HourlyCount), FalsePositive)
-		bf.GobDecode(data)
+// lockWrites counting 后端的写入持有 writeMtx 的读锁，返回解锁函数；写入方法之间不能互相调用，否则快照等待时会死锁
+func (m *HourlyBloomManager) lockWrites() func() {
+	if m.config.Backend != BackendCounting {
+		return func() {}
+	}
+	m.writeMtx.RLock()
+	return m.writeMtx.RUnlock
+}
 
-		filters[i] = &BloomFilterWithTime{
-			BF:        bf,
-			Timestamp: timestamp,
-		}
+// forEachShard 按分片分组处理一批 key，每个分片只加一次锁；同一分片内按原顺序处理
+func (m *HourlyBloomManager) forEachShard(keys []string, fn func(shard *bloomShard, i int)) {
+	groups := make([][]int, len(m.shards))
+	for i, key := range keys {
+		idx := xxhash.Sum64String(key) % uint64(len(m.shards))
+		groups[idx] = append(groups[idx], i)
 	}
 
-	m.filters = filters
-	return nil
+	for idx, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		shard := m.shards[idx]
+		<-shard.mtx
+		for _, i := range group {
+			fn(shard, i)
+		}
+		shard.mtx <- struct{}{}
+	}
 }
 
-// StartAutoSave 每小时自动保存一次
-func (m *HourlyBloomManager) StartAutoSave() {
+// StartAutoSave 每小时自动保存所有命名空间
+func (n *BloomNamespaces) StartAutoSave() {
 	go func() {
 		// 等待到下一个整点
 		now := time.Now()
@@ -246,50 +475,236 @@ func (m *HourlyBloomManager) StartAutoSave() {
 
 		ticker := time.NewTicker(time.Hour)
 		for range ticker.C {
-			if err := m.SaveToDisk(); err != nil {
-				log.Printf("自动保存失败: %v", err)
+			if err := n.SaveToDisk(); err != nil {
+				slog.Error("自动保存失败", "error", err)
 			}
 		}
 	}()
 }
 
-// HandleSignal 注册信号处理，退出时保存
-func (m *HourlyBloomManager) HandleSignal() {
+// HandleSignal 注册信号处理，退出时保存所有命名空间
+func (n *BloomNamespaces) HandleSignal() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-c
-		log.Printf("接收到信号 %v，正在保存状态并退出...", sig)
-		_ = m.SaveToDisk()
+		slog.Info("接收到信号，正在保存状态并退出", "signal", sig.String())
+		_ = n.SaveToDisk()
+		n.Close()
 		os.Exit(0)
 	}()
 }
 
+// AddItem POST /add 的单条数据
+type AddItem struct {
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"` // 事件时间，Unix 秒
+}
+
+// parseLookback 解析回看时长，除 time.ParseDuration 的格式外还支持按天（如 "7d"）
+func parseLookback(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid lookback: %s", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid lookback: %s", v)
+	}
+	return d, nil
+}
+
+// parseTime 解析 RFC3339 或 Unix 秒
+func parseTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseTimeRange 从 lookback 或 since/until 参数解析查询的时间范围，都不传时为整个窗口
+func parseTimeRange(c *gin.Context, window time.Duration) (since, until time.Time, err error) {
+	until = time.Now()
+	since = until.Add(-window)
+
+	if v := c.Query("lookback"); v != "" {
+		lookback, err := parseLookback(v)
+		if err != nil {
+			return since, until, err
+		}
+		return until.Add(-lookback), until, nil
+	}
+	if v := c.Query("since"); v != "" {
+		if since, err = parseTime(v); err != nil {
+			return since, until, fmt.Errorf("invalid since: %s", v)
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if until, err = parseTime(v); err != nil {
+			return since, until, fmt.Errorf("invalid until: %s", v)
+		}
+	}
+	if since.After(until) {
+		return since, until, fmt.Errorf("since must not be after until")
+	}
+	return since, until, nil
+}
+
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			os.Exit(runInspect(os.Args[2:]))
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		case "check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		}
+	}
+
+	config, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupLogger(os.Stderr, config.Log.Level, config.Log.Format); err != nil {
+		fmt.Fprintf(os.Stderr, "初始化日志失败: %v\n", err)
+		os.Exit(1)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-
-	manager := NewHourlyBloomManager()
-	rtaService := NewRtaService()
+	r.Use(metricsMiddleware())
 
 	// 初始化客户端
-	InitClients()
+	if err := InitClients(config.Redis, config.Cos); err != nil {
+		slog.Error("初始化客户端失败", "error", err)
+		os.Exit(1)
+	}
+
+	// 状态文件同一时间只能有一个进程写入，进程退出时释放
+	stateLock, err := lockState(config.Bloom.StatePath)
+	if err != nil {
+		slog.Error("锁定状态文件失败", "path", config.Bloom.StatePath, "error", err)
+		os.Exit(1)
+	}
+	defer stateLock.Close()
+
+	store, err := newSnapshotStore(config.Bloom.SnapshotBackend, filepath.Dir(config.Bloom.StatePath))
+	if err != nil {
+		slog.Error("创建快照存储失败", "error", err)
+		os.Exit(1)
+	}
+	namespaces := NewBloomNamespaces(config.Bloom, store, NewRedisExactStore(RedisClient, exactRedisPrefix))
+	metricsRegistry.MustRegister(newBloomCollector(namespaces))
+	manager := namespaces.Default()
+	rtaService := NewRtaService(config.Rta)
 
 	// 启动定时保存
-	manager.StartAutoSave()
+	namespaces.StartAutoSave()
 
 	// 初始化ip库
 	initXdb()
 
-	// 定时拉取
-	startAutoFetch(manager, rtaService)
-	//processMinute(manager, rtaService)
+	// 定时拉取，从上次的进度补齐错过的分钟
+	watermarks, err := newWatermarkStore(config.Checkpoint.Backend, config.Checkpoint.Path)
+	if err != nil {
+		slog.Error("创建 watermark 存储失败", "error", err)
+		os.Exit(1)
+	}
+	checkpoint, err := NewFetchCheckpoint(watermarks, config.Checkpoint.MaxCatchUp.Duration())
+	if err != nil {
+		slog.Error("初始化拉取进度失败", "store", watermarks.String(), "error", err)
+		os.Exit(1)
+	}
+	startAutoFetch(manager, rtaService, config.Fetch, NewDDJSender(config.DDJ), checkpoint)
 
 	// 注册信号处理
-	manager.HandleSignal()
+	namespaces.HandleSignal()
 
-	// 接口：POST /dedup
+	// 多实例复制，没有配置对端时不启用
+	if len(config.Replication.Peers) > 0 {
+		NewReplicator(namespaces, config.Replication).Start()
+	}
+
+	registerRoutes(r, namespaces)
+	registerReplicationRoutes(r, namespaces, config.Replication)
+
+	slog.Info("服务启动中", "port", config.HTTPPort)
+	if err := r.Run(config.HTTPPort); err != nil {
+		slog.Error("服务启动失败", "error", err)
+		os.Exit(1)
+	}
+}
+
+// registerReplicationRoutes 注册供其他实例拉取增量的接口。请求需要带上 replication.token，没有配置令牌时拒绝所有请求；
+// 每个对端同一时间只拉取一个命名空间，同时处理的请求数不超过对端数，超过时返回 429
+func registerReplicationRoutes(r *gin.Engine, namespaces *BloomNamespaces, config ReplicationConfig) {
+	slots := make(chan struct{}, max(len(config.Peers), 1))
+	for range cap(slots) {
+		slots <- struct{}{}
+	}
+
+	// 接口：GET /replication/buckets?namespace=xxx&since=<Unix 纳秒>，返回 since 之后本地有写入的桶，供其他实例拉取
+	r.GET("/replication/buckets", func(c *gin.Context) {
+		token := c.GetHeader(replicationTokenHeader)
+		if config.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			c.JSON(403, gin.H{"error": "invalid replication token"})
+			return
+		}
+		select {
+		case <-slots:
+			defer func() { slots <- struct{}{} }()
+		default:
+			c.JSON(429, gin.H{"error": "too many replication requests"})
+			return
+		}
+
+		ns, ok := namespaces.Lookup(c.Query("namespace"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+		since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid since"})
+			return
+		}
+
+		c.Header("Content-Type", "application/octet-stream")
+		if err := ns.writeDelta(c.Writer, since); err != nil {
+			ns.logger().Warn("写出增量失败", "error", err)
+		}
+	})
+}
+
+// registerRoutes 注册 HTTP 接口
+func registerRoutes(r *gin.Engine, namespaces *BloomNamespaces) {
+	// 接口：POST /dedup?namespace=xxx，不传 namespace 时使用默认命名空间
 	r.POST("/dedup", func(c *gin.Context) {
+		ns, err := namespaces.Get(c.Query("namespace"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		lookback := ns.Config().Window.Duration()
+		if v := c.Query("lookback"); v != "" {
+			// lookback 只能在布隆过滤器中判断，精确去重的命名空间不支持，避免绕过 Redis
+			if ns.Config().Exact {
+				c.JSON(400, gin.H{"error": "lookback is not supported on exact namespaces"})
+				return
+			}
+			if lookback, err = parseLookback(v); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
 		var req []string
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(400, gin.H{"error": "invalid json"})
@@ -301,17 +716,160 @@ func main() {
 			return
 		}
 
-		result := manager.Dedup(req)
+		// 没有指定 lookback 时按窗口去重，精确去重的命名空间走 Redis
+		var result []string
+		if c.Query("lookback") == "" {
+			result = ns.Dedup(req)
+		} else {
+			result = ns.DedupWithin(req, lookback)
+		}
 		c.JSON(200, result)
 	})
 
+	// 接口：GET /contains?key=xxx[&namespace=][&lookback=6h | &since=&until=]，只查询不写入
+	r.GET("/contains", func(c *gin.Context) {
+		ns, ok := namespaces.Lookup(c.Query("namespace"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+
+		key := c.Query("key")
+		if key == "" {
+			c.JSON(400, gin.H{"error": "missing key"})
+			return
+		}
+
+		since, until, err := parseTimeRange(c, ns.Config().Window.Duration())
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"key":   key,
+			"seen":  ns.ContainsBetween(key, since, until),
+			"since": since.Unix(),
+			"until": until.Unix(),
+		})
+	})
+
+	// 接口：POST /check[?namespace=][&lookback=6h | &since=&until=]，批量查询不写入
+	r.POST("/check", func(c *gin.Context) {
+		ns, ok := namespaces.Lookup(c.Query("namespace"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+
+		since, until, err := parseTimeRange(c, ns.Config().Window.Duration())
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		var req []string
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+
+		c.JSON(200, ns.ContainsBatchBetween(req, since, until))
+	})
+
+	// 接口：POST /add[?namespace=]，按每条数据的事件时间写入对应的桶，用于回放和补数
+	r.POST("/add", func(c *gin.Context) {
+		ns, ok := namespaces.Lookup(c.Query("namespace"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+
+		var req []AddItem
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+
+		added := 0
+		rejected := []string{}
+		for _, item := range req {
+			if _, err := ns.AddAt(item.Key, time.Unix(item.Timestamp, 0)); err != nil {
+				rejected = append(rejected, item.Key)
+				continue
+			}
+			added++
+		}
+		c.JSON(200, gin.H{"added": added, "rejected": rejected})
+	})
+
+	// 接口：GET /namespaces 列出所有命名空间
+	r.GET("/namespaces", func(c *gin.Context) {
+		c.JSON(200, namespaces.Configs())
+	})
+
+	// 接口：POST /namespaces 按指定参数创建命名空间
+	r.POST("/namespaces", func(c *gin.Context) {
+		var config NamespaceConfig
+		if err := c.ShouldBindJSON(&config); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+		ns, err := namespaces.Create(config)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, ns.Config())
+	})
+
+	// 接口：DELETE /dedup?namespace=xxx，请求体为 key 数组，从窗口内删除这些 key，使其可以再次通过去重；
+	// 只有 backend 为 counting 的命名空间支持
+	r.DELETE("/dedup", func(c *gin.Context) {
+		ns, ok := namespaces.Lookup(c.Query("namespace"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+		var req []string
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+
+		removed, err := ns.Remove(req)
+		if errors.Is(err, ErrRemoveUnsupported) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"removed": removed})
+	})
+
+	// 接口：GET /stats[?namespace=]，各桶的位数、哈希函数个数、填充率、估算基数和误判率，以及启动以来的调用统计；
+	// 不传 namespace 时返回所有命名空间
+	r.GET("/stats", func(c *gin.Context) {
+		name := c.Query("namespace")
+		if name == "" {
+			c.JSON(200, namespaces.Stats())
+			return
+		}
+		ns, ok := namespaces.Lookup(name)
+		if !ok {
+			c.JSON(404, gin.H{"error": "namespace not found"})
+			return
+		}
+		c.JSON(200, ns.Stats())
+	})
+
+	// 接口：GET /metrics，Prometheus 文本格式
+	r.GET("/metrics", metricsHandler())
+
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
-
-	log.Printf("服务启动中，监听端口 %s", HTTPPort)
-	if err := r.Run(HTTPPort); err != nil {
-		log.Fatalf("服务启动失败: %v", err)
-	}
 }
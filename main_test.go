@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func testHighVolumeDedup(t *testing.T) {
-	manager := NewHourlyBloomManager()
+	manager := newDefaultTestManager()
 
 	// 插入 10000 条测试数据
 	n := 10000
@@ -54,7 +76,7 @@ func test24HourWindow(t *testing.T) {
 	filters := [24]*BloomFilterWithTime{}
 	for i := 0; i < 24; i++ {
 		ts := time.Now().UTC().Add(-time.Duration(24-i) * time.Hour).Truncate(time.Hour).Unix()
-		bf := bloom.NewWithEstimates(HourlyCount, FalsePositive)
+		bf := bloom.NewWithEstimates(testCapacity, FalsePositive)
 		filters[i] = &BloomFilterWithTime{BF: bf, Timestamp: ts}
 	}
 
@@ -62,12 +84,7 @@ func test24HourWindow(t *testing.T) {
 	veryOldStr := "very_old_string"
 	filters[0].BF.AddString(veryOldStr)
 
-	manager := &HourlyBloomManager{
-		filters: filters,
-		current: 23,
-		mtx:     make(chan struct{}, 1),
-	}
-	manager.mtx <- struct{}{}
+	manager := newTestManager(filters[:], 23)
 
 	// 模拟当前时间是 now
 	now := time.Now().UTC()
@@ -77,7 +94,7 @@ func test24HourWindow(t *testing.T) {
 	newStr := "brand_new_string"
 
 	idx := manager.Add(newStr)
-	if currentHour != manager.filters[idx].Timestamp {
+	if currentHour != manager.shards[0].filters[idx].Timestamp {
 		t.Error("错误：新插入数据不在当前小时")
 	}
 
@@ -96,7 +113,7 @@ func testBatchDedupAPI(t *testing.T) {
 	// 创建测试用的 HTTP 服务
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
-	manager := NewHourlyBloomManager()
+	manager := newDefaultTestManager()
 
 	r.POST("/dedup", func(c *gin.Context) {
 		var req []string
@@ -155,11 +172,11 @@ func contains(slice []string, item string) bool {
 }
 
 func testPersistenceAndRecovery(t *testing.T) {
-	_ = os.Remove(StateFilePath)
+	removeStateFiles(StateFilePath)
 
 	// 第一阶段：写入数据并保存
 	{
-		manager := NewHourlyBloomManager()
+		manager := newDefaultTestManager()
 		testStr := "persistent_string"
 		manager.Add(testStr)
 		err := manager.SaveToDisk()
@@ -171,7 +188,7 @@ func testPersistenceAndRecovery(t *testing.T) {
 
 	// 第二阶段：重新加载
 	{
-		manager := NewHourlyBloomManager() // 会自动加载
+		manager := newDefaultTestManager() // 会自动加载
 		if !manager.Contains("persistent_string") {
 			t.Error("错误：持久化数据未正确恢复")
 		} else {
@@ -179,7 +196,7 @@ func testPersistenceAndRecovery(t *testing.T) {
 		}
 	}
 
-	_ = os.Remove(StateFilePath)
+	removeStateFiles(StateFilePath)
 }
 
 func testHourlyRolling(t *testing.T) {
@@ -188,48 +205,2525 @@ func testHourlyRolling(t *testing.T) {
 	prevHour := now.Add(-1 * time.Hour).Truncate(time.Hour)
 	currHour := now.Truncate(time.Hour)
 
-	manager := &HourlyBloomManager{
-		filters: [24]*BloomFilterWithTime{},
-		current: 0,
-		mtx:     make(chan struct{}, 1),
-	}
-	manager.mtx <- struct{}{}
+	manager := newTestManager(make([]*BloomFilterWithTime, 24), 0)
+	shard := manager.shards[0]
 
 	// 初始化：第0个为 prevHour
-	manager.filters[0] = &BloomFilterWithTime{
-		BF:        bloom.NewWithEstimates(HourlyCount, FalsePositive),
+	shard.filters[0] = &BloomFilterWithTime{
+		BF:        bloom.NewWithEstimates(testCapacity, FalsePositive),
 		Timestamp: prevHour.Unix(),
 	}
 
 	// 手动设置当前时间为 currHour
 	// 调用 Add 触发滚动
-	manager.getCurrentHourIndex() // 内部会判断时间不对，滚动
+	manager.Add("roll_trigger") // 内部会判断时间不对，滚动
 
 	// 验证 current 已更新
-	if manager.current != 1 {
-		t.Errorf("期望 current=1，实际=%d", manager.current)
+	if shard.current != 1 {
+		t.Errorf("期望 current=1，实际=%d", shard.current)
 	}
 
 	// 验证新小时已创建
-	if manager.filters[1] == nil || manager.filters[1].Timestamp != currHour.Unix() {
+	if shard.filters[1] == nil || shard.filters[1].Timestamp != currHour.Unix() {
 		t.Error("错误：未正确创建新小时的布隆过滤器")
 	}
 
 	// 验证旧数据仍可查（23小时内）
 	testStr := "from_prev_hour"
-	manager.filters[0].BF.AddString(testStr)
+	shard.filters[0].BF.AddString(testStr)
 	if !manager.Contains(testStr) {
 		t.Error("错误：1小时前的数据不应被丢弃")
 	}
 }
 
-func TestDedupService(t *testing.T) {
-	// 清理旧状态文件
-	_ = os.Remove(StateFilePath)
+func testNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	namespaces := &BloomNamespaces{
+		managers:   make(map[string]*HourlyBloomManager),
+		configPath: dir + "/namespaces.json",
+		statePath:  dir + "/bloom_state.bin",
+		mtx:        make(chan struct{}, 1),
+	}
+	namespaces.mtx <- struct{}{}
+	t.Cleanup(func() { namespaces.Close() })
 
-	t.Run("需求1: 大数据量去重", testHighVolumeDedup)
-	t.Run("需求2: 24小时窗口精度", test24HourWindow)
-	t.Run("需求3: 批量接口返回新字符串", testBatchDedupAPI)
-	t.Run("需求4: 持久化与恢复", testPersistenceAndRecovery)
-	t.Run("需求5: 每小时滚动更新", testHourlyRolling)
+	teamA, err := namespaces.Create(NamespaceConfig{Name: "team_a", Window: Duration(2 * time.Hour), Capacity: 1000, FalsePositive: 0.01})
+	if err != nil {
+		t.Fatalf("创建命名空间失败: %v", err)
+	}
+	teamB, err := namespaces.Create(NamespaceConfig{Name: "team_b", Capacity: 1000})
+	if err != nil {
+		t.Fatalf("创建命名空间失败: %v", err)
+	}
+	if teamA.statePath != dir+"/bloom_state_team_a.bin" {
+		t.Errorf("命名空间的状态文件应与默认状态文件在同一目录: %s", teamA.statePath)
+	}
+	if len(teamA.shards[0].filters) != 2 || len(teamB.shards[0].filters) != NumHours {
+		t.Errorf("窗口长度错误: team_a=%d team_b=%d", len(teamA.shards[0].filters), len(teamB.shards[0].filters))
+	}
+
+	// 不同命名空间的 key 互不影响
+	if got := teamA.Dedup([]string{"k1"}); len(got) != 1 {
+		t.Errorf("team_a 首次应返回新数据，实际: %v", got)
+	}
+	if got := teamB.Dedup([]string{"k1"}); len(got) != 1 {
+		t.Errorf("team_b 不应受 team_a 影响，实际: %v", got)
+	}
+	if got := teamA.Dedup([]string{"k1"}); len(got) != 0 {
+		t.Errorf("team_a 第二次应返回空，实际: %v", got)
+	}
+
+	// 再次获取返回同一个实例
+	if again, _ := namespaces.Get("team_a"); again != teamA {
+		t.Error("错误：同名命名空间应复用已有实例")
+	}
+
+	if _, err := namespaces.Get("bad/name"); err == nil {
+		t.Error("错误：非法命名空间名称应报错")
+	}
+
+	// 命名空间配置已持久化
+	configs, err := namespaces.loadConfigs()
+	if err != nil || len(configs) != 2 || configs[0] != teamA.Config() {
+		t.Errorf("命名空间配置未正确持久化: %v %v", configs, err)
+	}
+
+	// 只读接口和 /add 不会创建命名空间，不存在时返回 404
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerRoutes(r, namespaces)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/contains?namespace=team_typo&key=k1", nil),
+		httptest.NewRequest(http.MethodPost, "/check?namespace=team_typo", strings.NewReader(`["k1"]`)),
+		httptest.NewRequest(http.MethodPost, "/add?namespace=team_typo", strings.NewReader(`[{"key": "k1", "timestamp": 0}]`)),
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s 应返回 404，实际 %d", req.Method, req.URL, w.Code)
+		}
+	}
+	if _, ok := namespaces.Lookup("team_typo"); ok {
+		t.Error("错误：只读查询不应创建命名空间")
+	}
+	if configs, _ := namespaces.loadConfigs(); len(configs) != 2 {
+		t.Errorf("只读查询不应持久化新的命名空间: %v", configs)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/contains?namespace=team_a&key=k1", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"seen":true`) {
+		t.Errorf("已存在的命名空间应正常查询: %d %s", w.Code, w.Body.String())
+	}
+
+	// 达到上限后 /dedup 不再按需创建命名空间，已有的命名空间不受影响
+	namespaces.limit = 3
+	if _, err := namespaces.Get("team_c"); err != nil {
+		t.Fatalf("未达到上限时应创建命名空间: %v", err)
+	}
+	if _, err := namespaces.Get("team_d"); !errors.Is(err, ErrTooManyNamespaces) {
+		t.Errorf("达到上限时应返回 ErrTooManyNamespaces，实际 %v", err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dedup?namespace=team_typo", strings.NewReader(`["k1"]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("达到上限时 /dedup 应返回 400，实际 %d", w.Code)
+	}
+	if _, ok := namespaces.Lookup("team_typo"); ok {
+		t.Error("错误：达到上限后不应再创建命名空间")
+	}
+	if again, err := namespaces.Get("team_a"); err != nil || again != teamA {
+		t.Errorf("达到上限后已有的命名空间应正常获取: %v", err)
+	}
+
+	// 所有命名空间的桶合计超过内存上限时不再创建，POST /namespaces 返回 400
+	namespaces.limit, namespaces.maxMemory = 0, 64
+	for _, body := range []string{
+		`{"name": "team_big"}`,
+		`{"name": "team_big", "capacity": 18446744073709551615}`,
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/namespaces", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrNamespaceMemory.Error()) {
+			t.Errorf("超过内存上限时应返回 400，实际 %d %s", w.Code, w.Body.String())
+		}
+	}
+	if _, ok := namespaces.Lookup("team_big"); ok {
+		t.Error("错误：超过内存上限时不应创建命名空间")
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/namespaces", strings.NewReader(`{"name": "team_small", "capacity": 1000}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("未超过内存上限时应创建命名空间，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func testBucketGeometry(t *testing.T) {
+	config := NamespaceConfig{
+		Name:          "minutes",
+		Window:        Duration(10 * time.Minute),
+		Bucket:        Duration(time.Minute),
+		Capacity:      1000,
+		FalsePositive: 0.01,
+	}
+	statePath := t.TempDir() + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+	if len(manager.shards[0].filters) != 10 {
+		t.Fatalf("期望 10 个桶，实际 %d", len(manager.shards[0].filters))
+	}
+
+	// 当前桶按分钟对齐
+	currentMinute := time.Now().Truncate(time.Minute).Unix()
+	idx := manager.Add("minute_key")
+	if manager.shards[0].filters[idx].Timestamp != currentMinute {
+		t.Error("错误：新插入数据不在当前分钟桶")
+	}
+
+	// 窗口之外（11 分钟前）的桶不参与判断
+	manager.shards[0].filters[0].Timestamp = currentMinute - 11*60
+	manager.shards[0].filters[0].BF.AddString("stale_key")
+	if manager.Contains("stale_key") {
+		t.Error("错误：窗口之外的数据仍被识别")
+	}
+	manager.shards[0].filters[0].Timestamp = currentMinute - 9*60
+	if !manager.Contains("stale_key") {
+		t.Error("错误：窗口之内的数据未识别")
+	}
+
+	// 状态文件记录几何参数，重新加载后数据保留
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	reloaded := newHourlyBloomManager(config, statePath)
+	if !reloaded.Contains("minute_key") {
+		t.Error("错误：重新加载后数据丢失")
+	}
+
+	// 桶粒度变化时拒绝加载
+	config.Bucket = Duration(2 * time.Minute)
+	config.Window = Duration(20 * time.Minute)
+	changed := &HourlyBloomManager{config: config, statePath: statePath, store: NewLocalSnapshotStore(filepath.Dir(statePath))}
+	changed.initShards(1)
+	if err := changed.loadFromDisk(); err == nil {
+		t.Error("错误：桶粒度不一致时应拒绝加载")
+	}
+}
+
+func testLookback(t *testing.T) {
+	config := testNamespaceConfig("lookback")
+	manager := newTempManager(t, config)
+
+	// 3 小时前的桶里写入一条数据
+	now := time.Now()
+	threeHoursAgo := now.Add(-3 * time.Hour).Truncate(time.Hour).Unix()
+	for _, f := range manager.shards[0].filters {
+		if f.Timestamp == threeHoursAgo {
+			f.BF.AddString("old_key")
+		}
+	}
+
+	if manager.ContainsWithin("old_key", time.Hour) {
+		t.Error("错误：1 小时回看窗口不应命中 3 小时前的数据")
+	}
+	if !manager.ContainsWithin("old_key", 4*time.Hour) {
+		t.Error("错误：4 小时回看窗口应命中 3 小时前的数据")
+	}
+	if !manager.ContainsBetween("old_key", now.Add(-3*time.Hour), now.Add(-2*time.Hour)) {
+		t.Error("错误：时间范围内的数据未识别")
+	}
+	if manager.ContainsBetween("old_key", now.Add(-2*time.Hour), now) {
+		t.Error("错误：时间范围外的数据被识别")
+	}
+
+	// 回看窗口内视为重复，窗口外视为新数据并写入当前桶
+	if got := manager.DedupWithin([]string{"old_key"}, time.Hour); len(got) != 1 {
+		t.Errorf("1 小时回看窗口应返回新数据，实际: %v", got)
+	}
+	if !manager.ContainsWithin("old_key", time.Hour) {
+		t.Error("错误：Dedup 后数据应写入当前桶")
+	}
+
+	if d, err := parseLookback("7d"); err != nil || d != 7*24*time.Hour {
+		t.Errorf("解析 7d 失败: %v %v", d, err)
+	}
+	if _, err := parseLookback("-1h"); err == nil {
+		t.Error("错误：负数回看时长应报错")
+	}
+}
+
+func testContainsBatch(t *testing.T) {
+	config := testNamespaceConfig("check")
+	manager := newTempManager(t, config)
+
+	now := time.Now()
+	threeHoursAgo := now.Add(-3 * time.Hour).Truncate(time.Hour).Unix()
+	oneHourAgo := now.Add(-1 * time.Hour).Truncate(time.Hour).Unix()
+	for _, f := range manager.shards[0].filters {
+		if f.Timestamp == threeHoursAgo || f.Timestamp == oneHourAgo {
+			f.BF.AddString("seen_key")
+		}
+	}
+
+	results := manager.ContainsBatch([]string{"seen_key", "unseen_key"})
+	if len(results) != 2 {
+		t.Fatalf("期望 2 条结果，实际 %d", len(results))
+	}
+	if !results[0].Seen || results[0].Bucket != threeHoursAgo {
+		t.Errorf("seen_key 应首次命中 3 小时前的桶，实际: %+v", results[0])
+	}
+	if results[1].Seen || results[1].Bucket != 0 {
+		t.Errorf("unseen_key 不应命中，实际: %+v", results[1])
+	}
+
+	// 只查询不写入
+	if manager.Contains("unseen_key") {
+		t.Error("错误：ContainsBatch 不应写入数据")
+	}
+
+	// 限定时间范围后返回范围内最早命中的桶
+	results = manager.ContainsBatchBetween([]string{"seen_key"}, now.Add(-2*time.Hour), now)
+	if !results[0].Seen || results[0].Bucket != oneHourAgo {
+		t.Errorf("限定范围后应命中 1 小时前的桶，实际: %+v", results[0])
+	}
+}
+
+func testAddAt(t *testing.T) {
+	config := testNamespaceConfig("replay")
+	manager := newTempManager(t, config)
+
+	now := time.Now()
+	eventTime := now.Add(-5 * time.Hour)
+	idx, err := manager.AddAt("replayed_key", eventTime)
+	if err != nil {
+		t.Fatalf("AddAt 失败: %v", err)
+	}
+	if manager.shards[0].filters[idx].Timestamp != eventTime.Truncate(time.Hour).Unix() {
+		t.Error("错误：数据未写入事件时间对应的桶")
+	}
+	if manager.ContainsWithin("replayed_key", 4*time.Hour) {
+		t.Error("错误：数据不应出现在最近 4 小时的桶里")
+	}
+	if !manager.Contains("replayed_key") {
+		t.Error("错误：回放的数据未识别")
+	}
+
+	// 缺失的桶按需创建
+	missing := now.Add(-7 * time.Hour).Truncate(time.Hour).Unix()
+	for i, f := range manager.shards[0].filters {
+		if f.Timestamp == missing {
+			manager.shards[0].filters[i] = nil
+		}
+	}
+	idx, err = manager.AddAt("gap_key", now.Add(-7*time.Hour))
+	if err != nil || manager.shards[0].filters[idx].Timestamp != missing {
+		t.Errorf("错误：缺失的桶未被创建: %v", err)
+	}
+
+	// 早于窗口或晚于当前时间的拒绝写入
+	if _, err := manager.AddAt("too_old", now.Add(-25*time.Hour)); err != ErrOutsideWindow {
+		t.Errorf("早于窗口的数据应被拒绝，实际: %v", err)
+	}
+	if _, err := manager.AddAt("future", now.Add(2*time.Hour)); err != ErrOutsideWindow {
+		t.Errorf("未来的数据应被拒绝，实际: %v", err)
+	}
+	if got := manager.stats.add.stats().Keys; got != 2 {
+		t.Errorf("被拒绝的写入不应计入统计，add 应为 2，实际 %d", got)
+	}
+
+	// TestAndAddAt 和事件时间之前一个窗口到现在的数据比较，写入事件时间所在的桶
+	if added, err := manager.TestAndAddAt("replayed_key", now.Add(-3*time.Hour)); err != nil || added {
+		t.Errorf("5 小时前写入的数据在 3 小时前看应是重复: added=%v err=%v", added, err)
+	}
+	if added, err := manager.TestAndAddAt("replayed_key", now.Add(-6*time.Hour)); err != nil || added {
+		t.Errorf("事件时间之后已经写入的数据也应是重复: added=%v err=%v", added, err)
+	}
+	manager.Add("live_key")
+	if added, err := manager.TestAndAddAt("live_key", now.Add(-2*time.Hour)); err != nil || added {
+		t.Errorf("当前桶已有的数据补数时不应再次放行: added=%v err=%v", added, err)
+	}
+	if added, err := manager.TestAndAddAt("late_key", now.Add(-2*time.Hour)); err != nil || !added {
+		t.Errorf("没有出现过的数据应写入: added=%v err=%v", added, err)
+	}
+	if !manager.ContainsBetween("late_key", now.Add(-2*time.Hour), now.Add(-2*time.Hour)) ||
+		manager.ContainsBetween("late_key", now, now) {
+		t.Error("TestAndAddAt 应写入事件时间所在的桶")
+	}
+	if _, err := manager.TestAndAddAt("too_old", now.Add(-25*time.Hour)); err != ErrOutsideWindow {
+		t.Errorf("早于窗口的数据应被拒绝，实际: %v", err)
+	}
+}
+
+func testConcurrentDedup(t *testing.T) {
+	config := testNamespaceConfig("concurrent")
+	config.Capacity = 10000
+	manager := newTempManager(t, config)
+
+	const n = 64
+	var wg sync.WaitGroup
+	var newCount int64
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if got := manager.Dedup([]string{"same_key", "same_key"}); len(got) > 0 {
+				atomic.AddInt64(&newCount, int64(len(got)))
+			}
+			if manager.TestAndAdd("same_key_2") {
+				atomic.AddInt64(&newCount, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if newCount != 2 {
+		t.Errorf("%d 个并发请求中每个 key 应只有一个返回新数据，实际共 %d 个", n, newCount)
+	}
+}
+
+func testShardedPersistence(t *testing.T) {
+	config := testNamespaceConfig("sharded")
+	config.Capacity = 10000
+	config.Shards = 8
+	statePath := t.TempDir() + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+	if len(manager.shards) != 8 {
+		t.Fatalf("期望 8 个分片，实际 %d", len(manager.shards))
+	}
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("sharded_key_%d", i)
+	}
+	if got := manager.Dedup(keys); len(got) != len(keys) {
+		t.Fatalf("首次去重应全部为新数据，实际 %d 条", len(got))
+	}
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+
+	// 分片数变化时使用配置的分片数，已有的桶按原来的 8 个分片只读保留，数据不丢失
+	config.Shards = 4
+	reloaded := newHourlyBloomManager(config, statePath)
+	if len(reloaded.shards) != 4 || reloaded.Config().Shards != 4 {
+		t.Errorf("应使用配置的 4 个分片，实际 %d", len(reloaded.shards))
+	}
+	if got := reloaded.Dedup(keys); len(got) != 0 {
+		t.Errorf("重新加载后应全部为重复数据，实际 %d 条新数据", len(got))
+	}
+	if reloaded.Dedup([]string{"sharded_new"}) == nil {
+		t.Error("新数据应写入按配置分片的桶")
+	}
+
+	// 只读的桶随快照保存，再次加载后仍然有效
+	if err := reloaded.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	again := newHourlyBloomManager(config, statePath)
+	if len(again.shards) != 4 || len(again.shards[0].frozen) != 1 || len(again.shards[0].frozen[0].shards) != 8 {
+		t.Fatalf("再次加载后应有 4 个分片和一组 8 个分片的只读桶")
+	}
+	if got := again.Dedup(append(keys, "sharded_new")); len(got) != 0 {
+		t.Errorf("再次加载后应全部为重复数据，实际 %d 条新数据", len(got))
+	}
+
+	// 只读的桶整组过期后丢弃，不再写入快照
+	for _, shard := range again.shards {
+		<-shard.mtx
+		shard.dropFrozen(time.Now().Add(time.Hour).Unix())
+		shard.mtx <- struct{}{}
+	}
+	if again.Contains(keys[0]) {
+		t.Error("过期的只读桶不应再参与查询")
+	}
+}
+
+func testSnapshotIntegrity(t *testing.T) {
+	config := testNamespaceConfig("snapshot")
+	config.Window = Duration(3 * time.Hour)
+	config.Shards = 2
+	dir := t.TempDir()
+	statePath := dir + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+	manager.Add("snapshot_key")
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+
+	// 不残留临时文件和封存的预写日志
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("目录中应只有状态文件和预写日志，实际 %d 个文件", len(entries))
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("读取状态文件失败: %v", err)
+	}
+
+	// 篡改最后一个字节，校验和不匹配的桶被跳过
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	snap, err := readSnapshot(bytes.NewReader(corrupted))
+	if err != nil || len(snap.corrupt) != 1 || snap.numBuckets() != 5 {
+		t.Errorf("篡改后应跳过 1 个校验失败的桶，实际: %v %v", snap, err)
+	}
+
+	// 截断的文件返回错误
+	if _, err := readSnapshot(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Error("错误：截断的状态文件应返回错误")
+	}
+
+	// 大小字段与层头中的 m 不符时直接报错，不按损坏的大小分配内存
+	var layer bytes.Buffer
+	bf := bloom.New(1024, 7)
+	binary.Write(&layer, binary.BigEndian, uint64(bf.Cap()))
+	binary.Write(&layer, binary.BigEndian, uint64(bf.K()))
+	binary.Write(&layer, binary.BigEndian, int64(1<<40))
+	binary.Write(&layer, binary.BigEndian, uint32(0))
+	if _, _, err := readLayer(bytes.NewReader(layer.Bytes()), false, filterKindBloom); err == nil || !strings.Contains(err.Error(), "桶大小非法") {
+		t.Errorf("错误：大小字段损坏时应报错，实际 %v", err)
+	}
+	// 旧格式没有层头，按数据开头的 m 校验
+	bfData, _ := bf.GobEncode()
+	var legacyLayer bytes.Buffer
+	binary.Write(&legacyLayer, binary.BigEndian, int64(len(bfData)+8))
+	legacyLayer.Write(bfData)
+	if _, _, err := readLayer(bytes.NewReader(legacyLayer.Bytes()), true, filterKindBloom); err == nil {
+		t.Error("错误：旧格式大小字段损坏时应报错")
+	}
+	legacyLayer.Reset()
+	binary.Write(&legacyLayer, binary.BigEndian, int64(len(bfData)))
+	legacyLayer.Write(bfData)
+	if l, ok, err := readLayer(bytes.NewReader(legacyLayer.Bytes()), true, filterKindBloom); err != nil || !ok || !bytes.Equal(l.data, bfData) {
+		t.Errorf("旧格式的层应能读出: %v %v", ok, err)
+	}
+
+	// 崩溃时残留的临时文件在获取状态文件锁时删除
+	stale := filepath.Join(dir, "state.bin.tmp-12345")
+	if err := os.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockState(statePath)
+	if err != nil {
+		t.Fatalf("锁定状态文件失败: %v", err)
+	}
+	lock.Close()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("错误：残留的临时文件没有删除")
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("状态文件不应被删除: %v", err)
+	}
+
+	// 写入失败时不影响已有的状态文件
+	manager.store = NewLocalSnapshotStore(dir + "/missing_dir")
+	if err := manager.SaveToDisk(); err == nil {
+		t.Error("错误：目录不存在时应保存失败")
+	}
+	reloaded := newHourlyBloomManager(config, statePath)
+	if !reloaded.Contains("snapshot_key") {
+		t.Error("错误：已有状态文件被破坏")
+	}
+}
+
+func testPartialRecovery(t *testing.T) {
+	config := testNamespaceConfig("recovery")
+	statePath := t.TempDir() + "/state.bin"
+
+	// 模拟停机 2 小时前保存的状态：桶覆盖 25 小时前到 2 小时前
+	currentHour := time.Now().Truncate(time.Hour)
+	manager := &HourlyBloomManager{config: config, statePath: statePath, store: NewLocalSnapshotStore(filepath.Dir(statePath))}
+	manager.initShards(1)
+	shard := manager.shards[0]
+	for i := range shard.filters {
+		shard.filters[i] = shard.newFilter(currentHour.Add(-time.Duration(25-i) * time.Hour).Unix())
+	}
+	shard.filters[15].BF.AddString("ten_hours_ago")
+	shard.filters[0].BF.AddString("expired")
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+
+	reloaded := newHourlyBloomManager(config, statePath)
+	restored, dropped, missing := 0, 0, 0
+	for _, f := range reloaded.shards[0].filters {
+		age := currentHour.Unix() - f.Timestamp
+		switch {
+		case age >= 24*3600:
+			dropped++
+		case age <= 3600:
+			missing++
+		default:
+			restored++
+		}
+	}
+	if restored != 22 || dropped != 0 || missing != 2 {
+		t.Errorf("期望恢复 22 个、新建 2 个桶，实际恢复 %d 个、过期 %d 个、新建 %d 个", restored, dropped, missing)
+	}
+	if !reloaded.Contains("ten_hours_ago") {
+		t.Error("错误：窗口内的桶未被恢复")
+	}
+	if reloaded.Contains("expired") {
+		t.Error("错误：过期的桶不应被恢复")
+	}
+	if idx := reloaded.Add("now"); reloaded.shards[0].filters[idx].Timestamp != currentHour.Unix() {
+		t.Error("错误：恢复后未对齐到当前桶")
+	}
+}
+
+func testSnapshotMigration(t *testing.T) {
+	statePath := t.TempDir() + "/state.bin"
+
+	// 按旧格式（无文件头）写入 24 个桶，旧桶的容量和误判率与当前配置不同
+	currentHour := time.Now().Truncate(time.Hour)
+	var legacy bytes.Buffer
+	for i := 0; i < NumHours; i++ {
+		ts := currentHour.Add(-time.Duration(NumHours-1-i) * time.Hour).Unix()
+		bf := bloom.NewWithEstimates(500, 0.05)
+		if i == NumHours-1 {
+			bf.AddString("legacy_key")
+		}
+		data, _ := bf.GobEncode()
+		binary.Write(&legacy, binary.BigEndian, ts)
+		binary.Write(&legacy, binary.BigEndian, int64(len(data)))
+		legacy.Write(data)
+	}
+	if err := os.WriteFile(statePath, legacy.Bytes(), 0644); err != nil {
+		t.Fatalf("写入旧格式文件失败: %v", err)
+	}
+
+	// 旧格式只有 1 个分片，按配置的 4 个分片写入新数据，旧桶只读保留
+	config := testNamespaceConfig("migration")
+	config.Capacity = 2000
+	config.Shards = 4
+	manager := newHourlyBloomManager(config, statePath)
+	if !manager.Contains("legacy_key") {
+		t.Fatal("错误：旧格式文件中的数据未恢复")
+	}
+	if len(manager.shards) != 4 {
+		t.Errorf("旧格式文件加载后应使用配置的 4 个分片，实际 %d", len(manager.shards))
+	}
+
+	// 保存后迁移到最新版本，旧桶保留原来的 m/k
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	file, _ := os.Open(statePath)
+	defer file.Close()
+	snap, err := readSnapshot(file)
+	if err != nil || snap.version != stateVersion || snap.header.Shards != 4 || len(snap.frozen) != 1 {
+		t.Fatalf("迁移后的文件不正确: %+v %v", snap, err)
+	}
+	legacyBF := bloom.NewWithEstimates(500, 0.05)
+	frozen := snap.frozen[0].shards
+	if len(frozen) != 1 || len(frozen[0]) != NumHours {
+		t.Fatalf("旧桶应作为一组 1 个分片的只读桶保存，实际 %d 个分片", len(frozen))
+	}
+	for _, f := range frozen[0] {
+		if f.BF.Cap() != legacyBF.Cap() || f.BF.K() != legacyBF.K() {
+			t.Errorf("桶 %d 的 m/k 被改变: %d/%d", f.Timestamp, f.BF.Cap(), f.BF.K())
+		}
+	}
+
+	if code := runInspect([]string{statePath}); code != 0 {
+		t.Errorf("inspect 返回 %d", code)
+	}
+}
+
+func testWAL(t *testing.T) {
+	config := testNamespaceConfig("wal")
+	config.Capacity = 10000
+	config.Shards = 4
+	config.WALSync = WALSyncAlways
+	statePath := t.TempDir() + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+
+	keys := []string{"wal_a", "wal_b", "wal_c"}
+	manager.Dedup(keys)
+	manager.Add("wal_add")
+	manager.TestAndAdd("wal_test_and_add")
+	past := time.Now().Add(-5 * time.Hour)
+	if _, err := manager.AddAt("wal_past", past); err != nil {
+		t.Fatalf("AddAt 失败: %v", err)
+	}
+
+	// 没有快照、没有 Close，模拟进程被 kill -9 后重启
+	restarted := newHourlyBloomManager(config, statePath)
+	for _, key := range append(keys, "wal_add", "wal_test_and_add") {
+		if !restarted.Contains(key) {
+			t.Errorf("%s 应从预写日志恢复", key)
+		}
+	}
+	if !restarted.ContainsBetween("wal_past", past, past) {
+		t.Error("wal_past 应恢复到事件时间所在的桶")
+	}
+	if restarted.ContainsWithin("wal_past", time.Hour) {
+		t.Error("wal_past 不应出现在当前桶")
+	}
+
+	// 快照成功后日志被清空
+	if err := restarted.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	if info, err := os.Stat(walPath(statePath)); err != nil || info.Size() != 0 {
+		t.Errorf("快照后预写日志应为空: %v %v", info, err)
+	}
+	if sealed, _ := sealedWALs(walPath(statePath)); len(sealed) != 0 {
+		t.Errorf("快照后不应保留封存的日志: %v", sealed)
+	}
+
+	// 快照之后的写入仍由日志补回；日志末尾写了一半的记录被忽略
+	restarted.Add("wal_after_snapshot")
+	if err := restarted.Close(); err != nil {
+		t.Fatalf("关闭失败: %v", err)
+	}
+	f, err := os.OpenFile(walPath(statePath), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0x65})
+	f.Close()
+
+	reloaded := newHourlyBloomManager(config, statePath)
+	for _, key := range append(keys, "wal_add", "wal_after_snapshot") {
+		if !reloaded.Contains(key) {
+			t.Errorf("%s 应从快照和预写日志恢复", key)
+		}
+	}
+	if reloaded.Contains("wal_never_added") {
+		t.Error("未写入的 key 不应存在")
+	}
+
+	// 损坏的尾部在回放后被截掉，重启后追加的记录下次仍能回放
+	reloaded.Add("wal_after_restart")
+	reloaded.Close()
+	again := newHourlyBloomManager(config, statePath)
+	defer again.Close()
+	for _, key := range []string{"wal_after_snapshot", "wal_after_restart"} {
+		if !again.Contains(key) {
+			t.Errorf("%s 应在再次重启后从预写日志恢复", key)
+		}
+	}
+
+	// 关闭预写日志时不产生日志文件
+	config.Name = "wal_disabled"
+	config.WALSync = WALSyncDisabled
+	disabledPath := t.TempDir() + "/state.bin"
+	newHourlyBloomManager(config, disabledPath).Add("wal_disabled_key")
+	if _, err := os.Stat(walPath(disabledPath)); !os.IsNotExist(err) {
+		t.Errorf("关闭预写日志时不应创建日志文件: %v", err)
+	}
+
+	config.WALSync = "sometimes"
+	if err := config.Validate(); err == nil {
+		t.Error("不支持的刷盘策略应校验失败")
+	}
+}
+
+// memorySnapshotStore 内存中的快照存储，用于测试
+type memorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[string][]byte
+}
+
+func newMemorySnapshotStore() *memorySnapshotStore {
+	return &memorySnapshotStore{snapshots: make(map[string][]byte)}
+}
+
+func (s *memorySnapshotStore) String() string {
+	return "memory"
+}
+
+func (s *memorySnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[name] = buf.Bytes()
+	return nil
+}
+
+func (s *memorySnapshotStore) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.snapshots[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// hookSnapshotStore 写入快照前调用 beforeSave，用于模拟快照期间的并发写入
+type hookSnapshotStore struct {
+	SnapshotStore
+	beforeSave func()
+}
+
+func (s *hookSnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	s.beforeSave()
+	return s.SnapshotStore.Save(name, write)
+}
+
+func testSnapshotStore(t *testing.T) {
+	config := testNamespaceConfig("store")
+	config.Capacity = 10000
+	config.Shards = 4
+	config.WALSync = WALSyncDisabled
+	store := newMemorySnapshotStore()
+
+	// 新实例在共享存储中找不到快照时从空过滤器启动
+	first := newHourlyBloomManagerWithStore(config, t.TempDir()+"/state.bin", store)
+	if got := first.Dedup([]string{"store_a", "store_b"}); len(got) != 2 {
+		t.Fatalf("首次去重应全部为新数据，实际 %v", got)
+	}
+	if err := first.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	if _, ok := store.snapshots["state.bin"]; !ok {
+		t.Fatalf("快照应按状态文件名保存，实际 %v", store.snapshots)
+	}
+
+	// 替换主机：本地目录为空，从共享存储拉取最新快照
+	replacement := newHourlyBloomManagerWithStore(config, t.TempDir()+"/state.bin", store)
+	if got := replacement.Dedup([]string{"store_a", "store_b", "store_c"}); len(got) != 1 || got[0] != "store_c" {
+		t.Errorf("新实例应从共享快照恢复，实际新数据 %v", got)
+	}
+
+	// 写入失败时保留旧快照
+	before := store.snapshots["state.bin"]
+	failing := &failingSnapshotStore{memorySnapshotStore: store}
+	broken := newHourlyBloomManagerWithStore(config, t.TempDir()+"/state.bin", failing)
+	if err := broken.SaveToDisk(); err == nil {
+		t.Error("存储写入失败时应返回错误")
+	}
+	if !bytes.Equal(store.snapshots["state.bin"], before) {
+		t.Error("写入失败时不应覆盖旧快照")
+	}
+
+	if _, err := newSnapshotStore("ftp", t.TempDir()); err == nil {
+		t.Error("不支持的快照存储应报错")
+	}
+}
+
+// failingSnapshotStore 写到一半失败的快照存储
+type failingSnapshotStore struct {
+	*memorySnapshotStore
+}
+
+func (s *failingSnapshotStore) Save(name string, write func(w io.Writer) error) error {
+	return s.memorySnapshotStore.Save(name, func(w io.Writer) error {
+		if err := write(io.Discard); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	})
+}
+
+func testReplication(t *testing.T) {
+	config := testNamespaceConfig("repl")
+	config.Capacity = 10000
+	config.Shards = 4
+	config.WALSync = WALSyncDisabled
+	local := newTempManager(t, config)
+	remote := newTempManager(t, config)
+
+	remoteNamespaces := &BloomNamespaces{
+		managers: map[string]*HourlyBloomManager{"repl": remote},
+		mtx:      make(chan struct{}, 1),
+	}
+	remoteNamespaces.mtx <- struct{}{}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	registerReplicationRoutes(engine, remoteNamespaces, ReplicationConfig{Peers: []string{"http://local"}, Token: "repl-secret"})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		engine.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	namespaces := &BloomNamespaces{
+		managers: map[string]*HourlyBloomManager{"repl": local},
+		mtx:      make(chan struct{}, 1),
+	}
+	namespaces.mtx <- struct{}{}
+	replicator := NewReplicator(namespaces, ReplicationConfig{Peers: []string{server.URL}, Token: "repl-secret"})
+
+	// 对端写入的数据同步后在本地被视为重复
+	remote.Dedup([]string{"repl_a", "repl_b"})
+	local.Dedup([]string{"repl_local"})
+	past := time.Now().Add(-3 * time.Hour)
+	remote.AddAt("repl_past", past)
+	if merged, err := replicator.pull(server.URL, local); err != nil || merged == 0 {
+		t.Fatalf("首次复制失败: merged=%d err=%v", merged, err)
+	}
+	if n := testutil.ToFloat64(replicationBytes.WithLabelValues(config.Name, server.URL)); n == 0 {
+		t.Error("应记录拉取的增量字节数")
+	}
+	if got := local.Dedup([]string{"repl_a", "repl_b", "repl_local", "repl_new"}); len(got) != 1 || got[0] != "repl_new" {
+		t.Errorf("复制后只有 repl_new 是新数据，实际 %v", got)
+	}
+	if !local.ContainsBetween("repl_past", past, past) || local.ContainsWithin("repl_past", time.Hour) {
+		t.Error("repl_past 应合并到同一时间的桶")
+	}
+
+	// 没有新写入时增量为空；对端有新写入时只传有变化的桶
+	if merged, err := replicator.pull(server.URL, local); err != nil || merged != 0 {
+		t.Errorf("没有新写入时不应合并任何桶: merged=%d err=%v", merged, err)
+	}
+	remote.Add("repl_c")
+	if merged, err := replicator.pull(server.URL, local); err != nil || merged != 1 {
+		t.Errorf("应只合并 1 个有变化的桶: merged=%d err=%v", merged, err)
+	}
+	if !local.Contains("repl_c") {
+		t.Error("repl_c 应同步到本地")
+	}
+
+	// 合并进来的数据不会再被转发
+	var delta bytes.Buffer
+	fresh := newTempManager(t, config)
+	fresh.writeDelta(&delta, 0)
+	if _, merged, err := local.mergeDelta(&delta); err != nil || merged != 0 {
+		t.Errorf("没有本地写入时增量应为空: merged=%d err=%v", merged, err)
+	}
+
+	// 容量不一致的布隆过滤器作为远端层合并（两边按各自的历史估算了新桶容量），不影响本地的层
+	config.Capacity = 20000
+	other := newTempManager(t, config)
+	other.Add("repl_other")
+	if err := local.Merge(0, other.shards[0].filters[other.shards[0].current]); err != nil {
+		t.Errorf("容量不一致的桶应作为远端层合并: %v", err)
+	}
+	if f := local.shards[0].filters[local.shards[0].current]; len(f.Remote) != 1 || len(f.Layers) != 0 {
+		t.Error("容量不一致的桶应追加为一个远端层")
+	}
+	config.Shards = 2
+	delta.Reset()
+	newTempManager(t, config).writeDelta(&delta, 0)
+	if _, _, err := local.mergeDelta(&delta); err == nil {
+		t.Error("分片数不一致时应拒绝合并")
+	}
+
+	// 对端没有该命名空间时跳过
+	local.config.Name = "missing"
+	if merged, err := replicator.pull(server.URL, local); err != nil || merged != 0 {
+		t.Errorf("对端没有命名空间时应跳过: merged=%d err=%v", merged, err)
+	}
+	local.config.Name = "repl"
+
+	replicator.Sync()
+	if atomic.LoadInt32(&requests) != 5 {
+		t.Errorf("期望 5 次请求，实际 %d", requests)
+	}
+
+	// 令牌不对时拒绝
+	for _, token := range []string{"", "wrong"} {
+		intruder := NewReplicator(namespaces, ReplicationConfig{Peers: []string{server.URL}, Token: token})
+		if _, err := intruder.pull(server.URL, local); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("令牌 %q 应被拒绝，实际 %v", token, err)
+		}
+	}
+
+	// 同时处理的请求数不超过对端数（这里为 1），超过时返回 429
+	get := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/replication/buckets?namespace=repl", nil)
+		req.Header.Set(replicationTokenHeader, "repl-secret")
+		return req
+	}
+	slow := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(), entered: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		engine.ServeHTTP(slow, get())
+		close(done)
+	}()
+	<-slow.entered
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, get())
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("并发请求超过上限时应返回 429，实际 %d", w.Code)
+	}
+	close(slow.release)
+	<-done
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, get())
+	if w.Code != http.StatusOK {
+		t.Errorf("前一个请求结束后应正常返回，实际 %d", w.Code)
+	}
+}
+
+// blockingResponseWriter 第一次写入时阻塞，直到 release 关闭，模拟慢的对端
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingResponseWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.entered)
+		<-w.release
+	})
+	return w.ResponseRecorder.Write(p)
+}
+
+// memoryExactStore 内存中的精确去重存储，模拟 Redis SET NX EX，down 为 true 时模拟 Redis 不可用
+type memoryExactStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	down    bool
+	calls   int
+}
+
+func newMemoryExactStore() *memoryExactStore {
+	return &memoryExactStore{expires: make(map[string]time.Time)}
+}
+
+func (s *memoryExactStore) SetNX(ctx context.Context, namespace string, keys []string, ttl time.Duration) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.down {
+		return nil, errors.New("dial tcp: connection refused")
+	}
+
+	now := time.Now()
+	isNew := make([]bool, len(keys))
+	for i, key := range keys {
+		key = namespace + ":" + key
+		if expire, ok := s.expires[key]; ok && now.Before(expire) {
+			continue
+		}
+		s.expires[key] = now.Add(ttl)
+		isNew[i] = true
+	}
+	return isNew, nil
+}
+
+func (s *memoryExactStore) Remove(ctx context.Context, namespace string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.expires, namespace+":"+key)
+	}
+	return nil
+}
+
+func testExactTier(t *testing.T) {
+	dir := t.TempDir()
+	store := newMemoryExactStore()
+	namespaces := &BloomNamespaces{
+		managers:   make(map[string]*HourlyBloomManager),
+		configPath: dir + "/namespaces.json",
+		statePath:  dir + "/bloom_state.bin",
+		store:      newMemorySnapshotStore(),
+		exact:      store,
+		mtx:        make(chan struct{}, 1),
+	}
+	namespaces.mtx <- struct{}{}
+	t.Cleanup(func() { namespaces.Close() })
+
+	// 布隆过滤器容量极小，几乎所有 key 都会被误判为已存在
+	paid, err := namespaces.Create(NamespaceConfig{Name: "paid", Capacity: 1, FalsePositive: 0.5, Shards: 1, Exact: true})
+	if err != nil {
+		t.Fatalf("创建命名空间失败: %v", err)
+	}
+	bulk, err := namespaces.Create(NamespaceConfig{Name: "bulk", Capacity: 1000, Shards: 1})
+	if err != nil {
+		t.Fatalf("创建命名空间失败: %v", err)
+	}
+	if bulk.exact != nil {
+		t.Error("未开启 exact 的命名空间不应使用精确去重")
+	}
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("conversion_%d", i)
+	}
+	if got := paid.Dedup(append(keys, keys[0])); len(got) != len(keys) {
+		t.Fatalf("精确去重不应有误判，且同一批内的重复只算一次: 期望 %d 条，实际 %d 条", len(keys), len(got))
+	}
+	if got := paid.Dedup(keys); len(got) != 0 {
+		t.Errorf("第二次应全部重复，实际 %d 条新数据", len(got))
+	}
+	if !paid.TestAndAdd("conversion_new") || paid.TestAndAdd("conversion_new") {
+		t.Error("TestAndAdd 应走精确去重")
+	}
+
+	// Redis 不可用时回退到布隆过滤器，之前写入的 key 仍被识别为重复
+	store.down = true
+	if got := paid.Dedup(keys[:10]); len(got) != 0 {
+		t.Errorf("回退后已写入的 key 应仍为重复，实际 %v", got)
+	}
+	calls := store.calls
+	paid.Dedup([]string{"conversion_during_outage"})
+	if store.calls != calls {
+		t.Error("Redis 出错后应在退避时间内直接走布隆过滤器")
+	}
+
+	// 回退期间按事件时间写入的 key 记下来，恢复后写回 Redis
+	if _, err := paid.AddAt("backfill_during_outage", time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatalf("AddAt 失败: %v", err)
+	}
+	if paid.exact.pendingCount.Load() == 0 {
+		t.Error("回退期间写入的 key 应等待写回")
+	}
+
+	// 退避结束后恢复精确去重，先写回回退期间的 key
+	store.down = false
+	paid.exact.retryAfter.Store(0)
+	if got := paid.Dedup([]string{"conversion_after_outage"}); len(got) != 1 {
+		t.Errorf("恢复后应重新使用精确去重，实际 %v", got)
+	}
+	if n := paid.exact.pendingCount.Load(); n != 0 {
+		t.Errorf("恢复后应写回所有 key，剩余 %d 个", n)
+	}
+	if got := paid.Dedup([]string{"backfill_during_outage"}); len(got) != 0 {
+		t.Errorf("回退期间写入的 key 写回后应为重复，实际 %v", got)
+	}
+
+	// AddAt 和 TestAndAddAt 同样写入 Redis
+	if _, err := paid.AddAt("backfill_1", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("AddAt 失败: %v", err)
+	}
+	store.mu.Lock()
+	_, ok := store.expires["paid:backfill_1"]
+	store.mu.Unlock()
+	if !ok {
+		t.Error("AddAt 应写入精确去重")
+	}
+	if added, err := paid.TestAndAddAt("backfill_1", time.Now().Add(-2*time.Hour)); err != nil || added {
+		t.Errorf("TestAndAddAt 应通过精确去重识别已写入的 key: added=%v err=%v", added, err)
+	}
+	if added, err := paid.TestAndAddAt("backfill_2", time.Now().Add(-2*time.Hour)); err != nil || !added {
+		t.Errorf("TestAndAddAt 新的 key 应写入: added=%v err=%v", added, err)
+	}
+	if _, err := paid.TestAndAddAt("backfill_3", time.Now().Add(-48*time.Hour)); !errors.Is(err, ErrOutsideWindow) {
+		t.Errorf("窗口外的事件时间应返回 ErrOutsideWindow，实际 %v", err)
+	}
+
+	// HTTP 接口：不传 lookback 时同样走精确去重
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerRoutes(r, namespaces)
+	post := func(body string) []string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dedup?namespace=paid", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST /dedup 返回 %d: %s", w.Code, w.Body.String())
+		}
+		var got []string
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got
+	}
+	httpKeys, _ := json.Marshal([]string{"http_1", "http_2", "http_3", "http_4", "http_5"})
+	calls = store.calls
+	if got := post(string(httpKeys)); len(got) != 5 {
+		t.Errorf("精确去重的命名空间通过 HTTP 不应有误判，实际 %v", got)
+	}
+	if got := post(string(httpKeys)); len(got) != 0 {
+		t.Errorf("第二次请求应全部重复，实际 %v", got)
+	}
+	if store.calls != calls+2 {
+		t.Errorf("POST /dedup 应调用精确去重 2 次，实际 %d 次", store.calls-calls)
+	}
+
+	// lookback 只能在布隆过滤器中判断，精确去重的命名空间拒绝
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dedup?namespace=paid&lookback=1h", strings.NewReader(string(httpKeys))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("精确去重的命名空间传 lookback 应返回 400，实际 %d", w.Code)
+	}
+
+	// 写回期间并发删除和超出上限：删除的 key 不再放回，已写回的从 Redis 删除；超出上限时只丢弃新记下的 key
+	blocking := &blockingExactStore{memoryExactStore: newMemoryExactStore(), entered: make(chan struct{}), release: make(chan error)}
+	config := testNamespaceConfig("flushing")
+	config.Exact = true
+	flushing := newTempManager(t, config)
+	flushing.exact = newExactTier(blocking)
+	flushing.exact.maxPending = 4
+	flush := func() chan bool {
+		done := make(chan bool, 1)
+		go func() {
+			<-flushing.exact.flushMtx
+			done <- flushing.flushExact()
+			flushing.exact.flushMtx <- struct{}{}
+		}()
+		<-blocking.entered
+		return done
+	}
+	pendingKeys := func() []string {
+		<-flushing.exact.pendingMtx
+		defer func() { flushing.exact.pendingMtx <- struct{}{} }()
+		var keys []string
+		for _, p := range flushing.exact.pending {
+			keys = append(keys, p.key)
+		}
+		return keys
+	}
+	expires := time.Now().Add(time.Hour)
+	flushing.addPendingExact([]string{"a", "b", "c"}, expires)
+
+	done := flush()
+	flushing.removePendingExact([]string{"b"})
+	flushing.addPendingExact([]string{"d", "e", "f"}, expires)
+	blocking.release <- errors.New("dial tcp: connection refused")
+	if <-done {
+		t.Error("写回失败时应返回 false")
+	}
+	if got := pendingKeys(); fmt.Sprint(got) != "[a c f]" || flushing.exact.pendingCount.Load() != 3 {
+		t.Errorf("写回失败后应放回未删除的 key，并丢弃超出上限的新 key: %v", got)
+	}
+
+	done = flush()
+	flushing.removePendingExact([]string{"c"})
+	blocking.release <- nil
+	if !<-done || len(pendingKeys()) != 0 || flushing.exact.pendingCount.Load() != 0 {
+		t.Errorf("写回成功后不应有待写回的 key: %v", pendingKeys())
+	}
+	blocking.mu.Lock()
+	_, hasA := blocking.expires["flushing:a"]
+	_, hasC := blocking.expires["flushing:c"]
+	blocking.mu.Unlock()
+	if !hasA || hasC {
+		t.Errorf("写回后应有 a、没有写回期间删除的 c: a=%v c=%v", hasA, hasC)
+	}
+}
+
+// blockingExactStore 每次 SetNX 先通知 entered，再等待 release 决定是否失败，用于在写回中途并发修改
+type blockingExactStore struct {
+	*memoryExactStore
+	entered chan struct{}
+	release chan error
+}
+
+func (s *blockingExactStore) SetNX(ctx context.Context, namespace string, keys []string, ttl time.Duration) ([]bool, error) {
+	s.entered <- struct{}{}
+	if err := <-s.release; err != nil {
+		return nil, err
+	}
+	return s.memoryExactStore.SetNX(ctx, namespace, keys, ttl)
+}
+
+func testCountingBackend(t *testing.T) {
+	config := testNamespaceConfig("counting")
+	config.Capacity = 10000
+	config.Shards = 4
+	config.WALSync = WALSyncAlways
+	config.Backend = BackendCounting
+	statePath := t.TempDir() + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+
+	keys := []string{"device_a", "device_b", "device_c"}
+	past := time.Now().Add(-2 * time.Hour)
+	manager.Dedup(keys)
+	manager.AddAt("device_a", past)
+
+	// DDJ 拒绝后删除，之后可以再次通过去重；删除会作用于窗口内所有桶
+	if removed, err := manager.Remove([]string{"device_a", "device_b", "device_unknown"}); err != nil || removed != 2 {
+		t.Fatalf("期望删除 2 个，实际 %d: %v", removed, err)
+	}
+	if manager.ContainsBetween("device_a", past, past) {
+		t.Error("device_a 应从所有桶中删除")
+	}
+	if got := manager.Dedup([]string{"device_a", "device_c"}); len(got) != 1 || got[0] != "device_a" {
+		t.Errorf("删除后 device_a 应可以再次通过，实际 %v", got)
+	}
+
+	// 快照和预写日志都能还原计数布隆过滤器和删除操作
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	manager.Remove([]string{"device_c"})
+	reloaded := newHourlyBloomManager(config, statePath)
+	if f := reloaded.shards[0].filters[0]; f.CBF == nil || f.BF != nil {
+		t.Fatal("重新加载后应为计数布隆过滤器")
+	}
+	if !reloaded.Contains("device_a") || reloaded.Contains("device_b") || reloaded.Contains("device_c") {
+		t.Error("重新加载后数据不一致")
+	}
+	if code := runInspect([]string{statePath}); code != 0 {
+		t.Errorf("inspect 返回 %d", code)
+	}
+
+	// 快照期间的写入只记在新日志里，重启后计数不会被回放两次
+	concurrent := &hookSnapshotStore{SnapshotStore: NewLocalSnapshotStore(filepath.Dir(statePath)), beforeSave: func() {
+		reloaded.Add("device_during_save")
+	}}
+	reloaded.store = concurrent
+	if err := reloaded.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	reloaded.Close()
+	restarted := newHourlyBloomManager(config, statePath)
+	if removed, err := restarted.Remove([]string{"device_during_save"}); err != nil || removed != 1 {
+		t.Fatalf("期望删除 1 个，实际 %d: %v", removed, err)
+	}
+	if restarted.Contains("device_during_save") {
+		t.Error("快照期间的写入被回放了两次，删除一次后仍然存在")
+	}
+
+	// 过滤器类型与配置不一致时不加载
+	bloomConfig := config
+	bloomConfig.Backend = BackendBloom
+	mismatched := &HourlyBloomManager{config: bloomConfig, statePath: statePath, store: NewLocalSnapshotStore(filepath.Dir(statePath))}
+	mismatched.initShards(4)
+	if err := mismatched.loadFromDisk(); err == nil {
+		t.Error("过滤器类型不一致时应拒绝加载")
+	}
+
+	// 布隆过滤器不支持删除
+	bloomManager := newTempManager(t, bloomConfig)
+	if _, err := bloomManager.Remove([]string{"device_a"}); !errors.Is(err, ErrRemoveUnsupported) {
+		t.Errorf("布隆过滤器删除应返回 ErrRemoveUnsupported，实际 %v", err)
+	}
+
+	// 计数器饱和后不再减少，删除其他 key 不会导致漏判
+	small := NewCountingBloomFilter(8, 2)
+	for i := 0; i < 100; i++ {
+		small.AddString(fmt.Sprintf("saturate_%d", i))
+	}
+	small.AddString("keep")
+	small.RemoveString("saturate_0")
+	if !small.TestString("keep") {
+		t.Error("饱和的计数器不应被删除减少")
+	}
+	config.Backend = "cuckoo"
+	if err := config.Validate(); err == nil {
+		t.Error("不支持的过滤器应校验失败")
+	}
+}
+
+func testBucketScaling(t *testing.T) {
+	config := testNamespaceConfig("scaling")
+	config.Shards = 1
+	config.WALSync = WALSyncDisabled
+	statePath := t.TempDir() + "/state.bin"
+	manager := newHourlyBloomManager(config, statePath)
+
+	// 写入容量的 10 倍，超过后追加扩容层，没有漏判，误判率仍接近配置值
+	const n = 10000
+	for i := 0; i < n; i++ {
+		manager.Add(fmt.Sprintf("scaling_%d", i))
+	}
+	shard := manager.shards[0]
+	f := shard.filters[shard.current]
+	if len(f.Layers) == 0 {
+		t.Fatal("写入超过容量后应追加扩容层")
+	}
+	for i := 0; i < n; i++ {
+		if !manager.Contains(fmt.Sprintf("scaling_%d", i)) {
+			t.Fatalf("scaling_%d 漏判", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if manager.Contains(fmt.Sprintf("absent_%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.03 {
+		t.Errorf("扩容后误判率 %.4f 过高", rate)
+	}
+
+	// 扩容层随快照保存和加载
+	if err := manager.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	reloaded := newHourlyBloomManager(config, statePath)
+	rf := reloaded.shards[0].filters[reloaded.shards[0].current]
+	if len(rf.Layers) != len(f.Layers) || !reloaded.Contains("scaling_9999") {
+		t.Errorf("重新加载后扩容层不一致: %d 层，期望 %d 层", len(rf.Layers), len(f.Layers))
+	}
+	if code := runInspect([]string{statePath}); code != 0 {
+		t.Errorf("inspect 返回 %d", code)
+	}
+
+	// 复制增量携带扩容层
+	var delta bytes.Buffer
+	if err := manager.writeDelta(&delta, 0); err != nil {
+		t.Fatalf("编码增量失败: %v", err)
+	}
+	peer := newTempManager(t, config)
+	if _, _, err := peer.mergeDelta(&delta); err != nil {
+		t.Fatalf("合并增量失败: %v", err)
+	}
+	if !peer.Contains("scaling_0") || !peer.Contains("scaling_9999") {
+		t.Error("合并后应包含所有层的 key")
+	}
+
+	// 对端的扩容层与本地各层 m/k 不同，单独保存，本地写入仍然进入本地的层
+	pshard := peer.shards[0]
+	pf := pshard.filters[pshard.current]
+	if len(pf.Layers) != 0 || len(pf.Remote) != len(f.Layers) || pf.lastLayer() != pf.BF {
+		t.Errorf("对端的层不应成为本地写入层: 本地扩容层 %d，远端层 %d", len(pf.Layers), len(pf.Remote))
+	}
+	peer.Add("peer_local")
+	if !pf.BF.TestString("peer_local") {
+		t.Error("本地写入应进入本地的层")
+	}
+
+	// 远端层数已满时跳过多出的层，不影响合并
+	crowded := &BloomFilterWithTime{BF: bloom.NewWithEstimates(1000, 0.01), Timestamp: pf.Timestamp}
+	for i := 0; i < maxLayers; i++ {
+		crowded.Layers = append(crowded.Layers, bloom.NewWithEstimates(uint(3000+100*i), 0.001))
+	}
+	crowded.BF.AddString("crowded_key")
+	if err := peer.Merge(0, crowded); err != nil {
+		t.Fatalf("层数超过上限时合并不应失败: %v", err)
+	}
+	if len(pf.Remote) != maxLayers || !peer.Contains("crowded_key") {
+		t.Errorf("远端层数 %d，期望 %d", len(pf.Remote), maxLayers)
+	}
+
+	// 远端层随快照保存和加载，加载后仍然写入本地的层
+	if err := peer.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	reloadedPeer := newHourlyBloomManager(config, peer.statePath)
+	rpf := reloadedPeer.shards[0].filters[reloadedPeer.shards[0].current]
+	if len(rpf.Remote) != maxLayers || rpf.lastLayer() != rpf.BF || !reloadedPeer.Contains("scaling_9999") {
+		t.Errorf("重新加载后远端层不一致: %d 层", len(rpf.Remote))
+	}
+
+	// 新桶按历史同一时段的基数分配容量
+	<-shard.mtx
+	defer func() { shard.mtx <- struct{}{} }()
+	current := shard.filters[shard.current].Timestamp
+	oldest := shard.filters[shard.oldestSlot()]
+	for i := 0; i < 2000; i++ {
+		oldest.add(fmt.Sprintf("history_%d", i))
+	}
+	if shard.sizeFor(oldest.Timestamp+24*3600) != shard.capacity {
+		t.Error("没有历史时应按配置容量分配")
+	}
+	idx := shard.bucketIndex(current + 3600)
+	expected := uint(float64(oldest.approximatedSize()) * capacityHeadroom)
+	if got := shard.sizeFor(current + 3600); got != min(expected, shard.capacity) {
+		t.Errorf("按历史估算的容量 %d，期望 %d", got, min(expected, shard.capacity))
+	}
+	if shard.filters[idx].Timestamp != current+3600 || len(shard.history) != 1 {
+		t.Error("滚动时应记录被淘汰的桶的基数")
+	}
+
+	// 历史基数不持久化，重启后从恢复的已经写完的桶重建，之后淘汰时不重复记录
+	historyConfig := testNamespaceConfig("history")
+	historyConfig.Capacity = 100_000
+	historyConfig.Shards = 1
+	historyConfig.WALSync = WALSyncDisabled
+	historyPath := t.TempDir() + "/state.bin"
+	before := newHourlyBloomManager(historyConfig, historyPath)
+	past := time.Now().Add(-3 * time.Hour)
+	for i := 0; i < 2000; i++ {
+		before.AddAt(fmt.Sprintf("history_%d", i), past)
+	}
+	if err := before.SaveToDisk(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	restarted := newHourlyBloomManager(historyConfig, historyPath).shards[0]
+	pastBucket := restarted.bucketStart(past)
+	var pastFilter *BloomFilterWithTime
+	for _, f := range restarted.filters {
+		if f.Timestamp == pastBucket {
+			pastFilter = f
+		}
+	}
+	expected = uint(float64(pastFilter.approximatedSize()) * capacityHeadroom)
+	if got := restarted.sizeFor(pastBucket + 24*3600); got != expected || got >= restarted.capacity {
+		t.Errorf("重启后应按恢复的桶估算容量 %d，实际 %d", expected, got)
+	}
+	restarted.observe(pastFilter)
+	if n := len(restarted.history[restarted.daySlot(pastBucket)]); n != 1 {
+		t.Errorf("同一个桶的基数只应记录一次，实际 %d 次", n)
+	}
+	if err := historyConfig.Validate(); err != nil {
+		t.Fatalf("配置无效: %v", err)
+	}
+	historyConfig.Bucket = Duration(7 * time.Hour)
+	historyConfig.Window = Duration(28 * time.Hour)
+	if err := historyConfig.Validate(); err == nil {
+		t.Error("不能整除一天的桶粒度应校验失败")
+	}
+}
+
+func testStats(t *testing.T) {
+	config := testNamespaceConfig("stats")
+	config.Window = Duration(6 * time.Hour)
+	config.Capacity = 10000
+	config.Shards = 4
+	config.WALSync = WALSyncDisabled
+	manager := newTempManager(t, config)
+
+	manager.Dedup([]string{"stats_a", "stats_b"})
+	manager.Dedup([]string{"stats_a", "stats_c"})
+	manager.TestAndAdd("stats_b")
+	manager.Add("stats_d")
+	manager.AddAt("stats_e", time.Now().Add(-2*time.Hour))
+	manager.Contains("stats_a")
+	manager.ContainsBatch([]string{"stats_c", "stats_unknown"})
+
+	stats := manager.Stats()
+	if stats.Dedup.Calls != 3 || stats.Dedup.Keys != 5 || stats.Dedup.Hits != 2 || stats.Dedup.HitRatio != 0.4 {
+		t.Errorf("dedup 统计错误: %+v", stats.Dedup)
+	}
+	if stats.Contains.Calls != 2 || stats.Contains.Keys != 3 || stats.Contains.Hits != 2 {
+		t.Errorf("contains 统计错误: %+v", stats.Contains)
+	}
+	if stats.Add.Calls != 2 || stats.Add.Keys != 2 {
+		t.Errorf("add 统计错误: %+v", stats.Add)
+	}
+
+	// 每个时间桶汇总所有分片，按时间升序，估算基数之和等于写入的 key 数
+	if len(stats.Buckets) != config.NumBuckets() {
+		t.Fatalf("期望 %d 个桶，实际 %d", config.NumBuckets(), len(stats.Buckets))
+	}
+	elements := uint64(0)
+	for i, b := range stats.Buckets {
+		if i > 0 && b.Timestamp <= stats.Buckets[i-1].Timestamp {
+			t.Error("桶应按时间升序")
+		}
+		if b.Bits == 0 || b.Hashes == 0 || b.FillRatio < 0 || b.FillRatio > 1 {
+			t.Errorf("桶统计非法: %+v", b)
+		}
+		elements += b.EstimatedElements
+	}
+	if elements != 5 {
+		t.Errorf("估算基数之和应为 5，实际 %d", elements)
+	}
+	last := stats.Buckets[len(stats.Buckets)-1]
+	if last.FillRatio == 0 || last.EstimatedFalsePositive <= 0 || last.EstimatedFalsePositive > config.FalsePositive {
+		t.Errorf("当前桶统计异常: %+v", last)
+	}
+}
+
+func testMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"status": "ok"}) })
+	r.GET("/metrics", metricsHandler())
+
+	before := testutil.ToFloat64(adxInvalid.WithLabelValues("de", "gaid"))
+	adxInvalid.WithLabelValues("de", "gaid").Add(3)
+	if got := testutil.ToFloat64(adxInvalid.WithLabelValues("de", "gaid")) - before; got != 3 {
+		t.Errorf("无效 GAID 计数应增加 3，实际 %v", got)
+	}
+
+	for _, path := range []string{"/health", "/health", "/no_such_route"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("/metrics 返回 %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`pando_http_request_duration_seconds_count{method="GET",route="/health",status="200"}`,
+		`pando_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"}`,
+		`pando_adx_invalid_total{reason="gaid",region="de"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics 缺少 %s", want)
+		}
+	}
+
+	// 命名空间的调用统计在抓取时读取
+	config := testNamespaceConfig("metrics")
+	config.Window = Duration(time.Hour)
+	config.Shards = 1
+	config.WALSync = WALSyncDisabled
+	manager := newTempManager(t, config)
+	manager.Dedup([]string{"m_a", "m_b"})
+	manager.Dedup([]string{"m_a"})
+	namespaces := &BloomNamespaces{
+		managers: map[string]*HourlyBloomManager{"metrics": manager},
+		mtx:      make(chan struct{}, 1),
+	}
+	namespaces.mtx <- struct{}{}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newBloomCollector(namespaces))
+	expected := `
+# HELP pando_bloom_hits_total 命中的 key 数：contains 为已出现过，dedup 为重复
+# TYPE pando_bloom_hits_total counter
+pando_bloom_hits_total{namespace="metrics",op="add"} 0
+pando_bloom_hits_total{namespace="metrics",op="contains"} 0
+pando_bloom_hits_total{namespace="metrics",op="dedup"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "pando_bloom_hits_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+// removeStateFiles 删除状态文件及其预写日志
+func removeStateFiles(statePath string) {
+	_ = os.Remove(statePath)
+	_ = os.Remove(walPath(statePath))
+	sealed, _ := sealedWALs(walPath(statePath))
+	removeWALs(sealed)
+}
+
+// testNamespaceConfig 测试用的命名空间配置：24 个 1 小时的桶，每个桶 1000 条，误判率 1%
+func testNamespaceConfig(name string) NamespaceConfig {
+	return NamespaceConfig{
+		Name:          name,
+		Window:        Duration(24 * time.Hour),
+		Bucket:        Duration(time.Hour),
+		Capacity:      1000,
+		FalsePositive: 0.01,
+	}
+}
+
+// newTempManager 在临时目录中创建命名空间管理器
+func newTempManager(t *testing.T, config NamespaceConfig) *HourlyBloomManager {
+	return newHourlyBloomManager(config, t.TempDir()+"/state.bin")
+}
+
+// testCapacity 测试中默认命名空间每个桶的容量。按线上的 HourlyCount 每个管理器要占用 2GB 以上内存，
+// 在 -race 下保存和加载都很慢
+const testCapacity = 100_000
+
+// testDefaultConfig 默认命名空间的配置，容量缩小到 testCapacity
+func testDefaultConfig() NamespaceConfig {
+	config := DefaultNamespaceConfig()
+	config.Capacity = testCapacity
+	return config
+}
+
+// newDefaultTestManager 同 NewHourlyBloomManager，容量缩小到 testCapacity，状态文件仍为 StateFilePath
+func newDefaultTestManager() *HourlyBloomManager {
+	return newHourlyBloomManager(testDefaultConfig(), StateFilePath)
+}
+
+// newTestManager 构造只有一个分片的默认命名空间管理器（绕过磁盘加载和时间对齐）
+func newTestManager(filters []*BloomFilterWithTime, current int) *HourlyBloomManager {
+	manager := &HourlyBloomManager{config: testDefaultConfig()}
+	manager.initShards(1)
+	manager.shards[0].filters = filters
+	manager.shards[0].current = current
+	return manager
+}
+
+func TestDedupService(t *testing.T) {
+	// 清理旧状态文件
+	removeStateFiles(StateFilePath)
+	t.Cleanup(func() { removeStateFiles(StateFilePath) })
+
+	t.Run("需求1: 大数据量去重", testHighVolumeDedup)
+	t.Run("需求2: 24小时窗口精度", test24HourWindow)
+	t.Run("需求3: 批量接口返回新字符串", testBatchDedupAPI)
+	t.Run("需求4: 持久化与恢复", testPersistenceAndRecovery)
+	t.Run("需求5: 每小时滚动更新", testHourlyRolling)
+	t.Run("需求6: 命名空间隔离", testNamespaces)
+	t.Run("需求7: 可配置的桶粒度与窗口", testBucketGeometry)
+	t.Run("需求8: 按回看时长查询", testLookback)
+	t.Run("需求9: 只读批量查询", testContainsBatch)
+	t.Run("需求10: 按事件时间写入", testAddAt)
+	t.Run("需求11: 并发去重原子性", testConcurrentDedup)
+	t.Run("需求12: 分片与持久化", testShardedPersistence)
+	t.Run("需求13: 快照原子写入与校验", testSnapshotIntegrity)
+	t.Run("需求14: 部分恢复", testPartialRecovery)
+	t.Run("需求15: 旧版本状态文件迁移", testSnapshotMigration)
+	t.Run("需求16: 预写日志", testWAL)
+	t.Run("需求17: 快照存储", testSnapshotStore)
+	t.Run("需求18: 多实例复制", testReplication)
+	t.Run("需求19: 精确去重", testExactTier)
+	t.Run("需求20: 支持删除的计数布隆过滤器", testCountingBackend)
+	t.Run("需求21: 桶容量自适应", testBucketScaling)
+	t.Run("需求22: 饱和度和调用统计", testStats)
+	t.Run("需求23: Prometheus 指标", testMetrics)
+	t.Run("需求24: 结构化日志", testLogging)
+	t.Run("需求25: 配置文件和环境变量", testConfig)
+	t.Run("需求26: 流式拉取 ADX 日志", testAdxStream)
+	t.Run("需求27: 分页列出并并行下载 ADX 日志", testAdxPagination)
+	t.Run("需求28: 读取压缩的 ADX 日志", testAdxCompression)
+	t.Run("需求29: 按 watermark 补齐错过的分钟", testCheckpoint)
+	t.Run("需求30: 手动补一段时间的数据", testBackfill)
+}
+
+func testLogging(t *testing.T) {
+	if _, err := newLogger(io.Discard, "verbose", LogFormatJSON); err == nil {
+		t.Error("未知的日志级别应返回错误")
+	}
+	if _, err := newLogger(io.Discard, "info", "xml"); err == nil {
+		t.Error("未知的日志格式应返回错误")
+	}
+
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "INFO", LogFormatJSON)
+	if err != nil {
+		t.Fatalf("创建日志失败: %v", err)
+	}
+	runLogger := logger.With("run_id", "run-1", "minute", "20261017 10:05").With("region", RegionSG)
+	runLogger.Debug("不应输出")
+	runLogger.Info("下载完成", "lines", 42)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("info 级别下应只输出 1 行，实际: %q", buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("日志不是 JSON: %v", err)
+	}
+	for key, want := range map[string]any{
+		"level": "INFO", "msg": "下载完成", "run_id": "run-1", "minute": "20261017 10:05", "region": "sg", "lines": float64(42),
+	} {
+		if entry[key] != want {
+			t.Errorf("字段 %s 期望 %v，实际 %v", key, want, entry[key])
+		}
+	}
+
+	// 命名空间和分片的日志带上对应字段
+	var text bytes.Buffer
+	if err := setupLogger(&text, "debug", LogFormatText); err != nil {
+		t.Fatalf("设置日志失败: %v", err)
+	}
+	previous := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+	config := &NamespaceConfig{Name: "logs", Window: Duration(time.Hour), Bucket: Duration(time.Hour)}
+	newBloomShard(0, config, 1000).logger().Info("滚动到新桶")
+	log.Printf("标准库日志")
+	if out := text.String(); !strings.Contains(out, "namespace=logs shard=0") || !strings.Contains(out, "标准库日志") {
+		t.Errorf("日志缺少命名空间字段或标准库日志: %q", out)
+	}
+}
+
+func testConfig(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	secrets := map[string]string{
+		"PANDO_REDIS_PASSWORD": "secret",
+		"PANDO_COS_SECRET_ID":  "id",
+		"PANDO_COS_SECRET_KEY": "key",
+		"PANDO_RTA_ZHIKE_AK":   "zhike_ak",
+		"PANDO_RTA_ZHIKE_SK":   "zhike_sk",
+		"PANDO_RTA_VIKING_AK":  "viking_ak",
+		"PANDO_RTA_VIKING_SK":  "viking_sk",
+	}
+
+	// 密钥没有默认值，必须显式提供
+	_, err := LoadConfig(nil, noEnv)
+	if err == nil {
+		t.Fatal("未提供密钥时应返回错误")
+	}
+	for _, want := range []string{"cos.secretId", "rta.zhikeAk"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息缺少 %s: %v", want, err)
+		}
+	}
+	config, err := LoadConfig(nil, func(k string) string { return secrets[k] })
+	if err != nil {
+		t.Fatalf("只提供密钥的默认配置应有效: %v", err)
+	}
+	if config.HTTPPort != HTTPPort || config.Bloom.Capacity != HourlyCount || config.Cos.Endpoints[RegionSG] != EpSg ||
+		config.Replication.Interval.Duration() != ReplicationInterval || len(config.Replication.Peers) != 0 {
+		t.Errorf("默认配置不正确: %+v", config)
+	}
+
+	// Redis 可以没有密码，但必须有地址
+	if _, err := LoadConfig(nil, func(k string) string {
+		if k == "PANDO_REDIS_PASSWORD" {
+			return ""
+		}
+		return secrets[k]
+	}); err != nil {
+		t.Errorf("没有密码的 Redis 应有效: %v", err)
+	}
+	config.Redis.Addr = ""
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "redis.addr") {
+		t.Errorf("redis.addr 为空时应校验失败: %v", err)
+	}
+
+	// 内存上限至少能放下默认命名空间
+	if config.Bloom.MaxMemoryMB != MaxNamespaceMemoryMB {
+		t.Errorf("默认内存上限不正确: %d", config.Bloom.MaxMemoryMB)
+	}
+	config.Bloom.MaxMemoryMB = 1024
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "bloom.maxMemoryMB") {
+		t.Errorf("内存上限放不下默认命名空间时应校验失败: %v", err)
+	}
+
+	// 配置文件只覆盖写了的字段，环境变量覆盖配置文件，命令行参数覆盖环境变量
+	path := t.TempDir() + "/config.json"
+	data := `{
+		"httpPort": ":9090",
+		"redis": {"addr": "10.0.0.1:6379"},
+		"cos": {"endpoints": {"us": "https://us.example.com"}},
+		"ddj": {"machines": ["10.0.0.5"], "port": 9000},
+		"fetch": {"workers": 16},
+		"bloom": {"window": "48h", "capacity": 1000},
+		"replication": {"peers": ["http://10.0.0.2:8080"]}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		ConfigEnv:                    path,
+		"PANDO_HTTP_PORT":            ":9191",
+		"PANDO_DDJ_MACHINES":         "10.0.0.6,10.0.0.7",
+		"PANDO_COS_ENDPOINT_DE":      "https://de.example.com",
+		"PANDO_BLOOM_SHARDS":         "4",
+		"PANDO_FETCH_RETRY_BACKOFF":  "2s",
+		"PANDO_REPLICATION_INTERVAL": "10s",
+		"PANDO_REPLICATION_TOKEN":    "repl-secret",
+	}
+	for k, v := range secrets {
+		env[k] = v
+	}
+	config, err = LoadConfig([]string{"-port", ":9292", "-log-level", "debug"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	if config.HTTPPort != ":9292" || config.Log.Level != "debug" || config.Log.Format != LogFormat {
+		t.Errorf("命令行参数未生效: %+v", config)
+	}
+	if config.Redis.Addr != "10.0.0.1:6379" || config.Redis.Password != "secret" {
+		t.Errorf("Redis 配置不正确: %+v", config.Redis)
+	}
+	if config.Cos.Endpoints[RegionUS] != "https://us.example.com" || config.Cos.Endpoints[RegionDE] != "https://de.example.com" ||
+		config.Cos.Endpoints[RegionSG] != EpSg {
+		t.Errorf("COS 地址不正确: %v", config.Cos.Endpoints)
+	}
+	if config.Fetch != (FetchConfig{Workers: 16, Retries: AdxRetries, RetryBackoff: Duration(2 * time.Second), MaxLineBytes: AdxMaxLineBytes}) {
+		t.Errorf("拉取配置不正确: %+v", config.Fetch)
+	}
+	ns := config.Bloom.NamespaceConfig()
+	if ns.Window.Duration() != 48*time.Hour || ns.Capacity != 1000 || ns.Shards != 4 || ns.FalsePositive != FalsePositive {
+		t.Errorf("默认命名空间配置不正确: %+v", ns)
+	}
+	if len(config.Replication.Peers) != 1 || config.Replication.Interval.Duration() != 10*time.Second || config.Replication.Token != "repl-secret" {
+		t.Errorf("复制配置不正确: %+v", config.Replication)
+	}
+	if got := NewDDJSender(config.DDJ).URL(); got != "http://10.0.0.6:9000"+DDJPath && got != "http://10.0.0.7:9000"+DDJPath {
+		t.Errorf("DDJ 地址不正确: %s", got)
+	}
+
+	// 配置了对端时必须有复制令牌
+	config.Replication.Token = ""
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "replication.token") {
+		t.Errorf("配置了对端但没有令牌时应校验失败: %v", err)
+	}
+
+	// 示例配置文件的字段与 Config 一致，占位符满足校验
+	if _, err := LoadConfig([]string{"-config", "pando-bloom.example.json"}, noEnv); err != nil {
+		t.Errorf("示例配置文件无效: %v", err)
+	}
+	if code := runCheckConfig([]string{"-config", path + ".missing"}); code != 2 {
+		t.Errorf("配置文件不存在时 check-config 应返回 2，实际 %d", code)
+	}
+
+	// 所有问题一次报告
+	env = map[string]string{"PANDO_LOG_LEVEL": "loud", "PANDO_BLOOM_BUCKET": "7m", "PANDO_SNAPSHOT_BACKEND": "ftp",
+		"PANDO_CHECKPOINT_BACKEND": "s3"}
+	_, err = LoadConfig(nil, func(k string) string { return env[k] })
+	if err == nil {
+		t.Fatal("无效配置应返回错误")
+	}
+	for _, want := range []string{"log", "bloom", "snapshotBackend", "checkpoint.backend"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息缺少 %s: %v", want, err)
+		}
+	}
+
+	if _, err := LoadConfig(nil, func(k string) string { return map[string]string{"PANDO_DDJ_PORT": "http"}[k] }); err == nil ||
+		!strings.Contains(err.Error(), "PANDO_DDJ_PORT") {
+		t.Errorf("无效的环境变量应指出变量名: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(`{"redis": {"adress": "x"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig([]string{"-config", path}, noEnv); err == nil {
+		t.Error("配置文件中的未知字段应返回错误")
+	}
+	if _, err := LoadConfig([]string{"-config", path + ".missing"}, noEnv); err == nil {
+		t.Error("指定的配置文件不存在时应返回错误")
+	}
+}
+
+// fakeCos 模拟 COS 桶：按 marker 分页列出对象和下载对象，可以让下载先失败几次或中途断开
+type fakeCos struct {
+	objects    map[string]string
+	listStatus int               // 非 200 时列出对象失败
+	listErrors int               // 前几次列出对象返回 503
+	pageSize   int               // 每页最多返回的对象数，0 为不分页
+	failures   map[string]int    // 对象 -> 前几次下载返回 failStatus
+	failStatus int               // 注入的下载失败返回的状态码，0 为 503
+	truncate   map[string]int    // 对象 -> 第一次返回内容时只写前几个字节就断开
+	encodings  map[string]string // 对象 -> Content-Encoding
+
+	mu        sync.Mutex
+	pages     int            // 列出对象的请求数
+	downloads map[string]int // 对象 -> 下载请求数
+}
+
+// newFakeCos 不分页、不注入下载失败的 COS 桶
+func newFakeCos(t *testing.T, objects map[string]string, listStatus int) *cos.Client {
+	return (&fakeCos{objects: objects, listStatus: listStatus}).client(t)
+}
+
+func (f *fakeCos) client(t *testing.T) *cos.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.URL.Path == "/" {
+			f.list(w, r)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.downloads == nil {
+			f.downloads = make(map[string]int)
+		}
+		f.downloads[key]++
+		if f.downloads[key] <= f.failures[key] {
+			w.WriteHeader(cmp.Or(f.failStatus, http.StatusServiceUnavailable))
+			return
+		}
+		if enc := f.encodings[key]; enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
+		if n, ok := f.truncate[key]; ok && f.downloads[key] == f.failures[key]+1 {
+			// 声明完整长度但只写一部分，客户端读到 unexpected EOF
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			io.WriteString(w, data[:n])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, data)
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	// 不复用连接，测试中可以按 goroutine 数检查下载是否全部退出
+	return cos.NewClient(&cos.BaseURL{BucketURL: u}, &http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+}
+
+// list 按 prefix 和 marker 返回一页对象，调用方需持有 f.mu
+func (f *fakeCos) list(w http.ResponseWriter, r *http.Request) {
+	f.pages++
+	if f.pages <= f.listErrors {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if f.listStatus != http.StatusOK {
+		w.WriteHeader(f.listStatus)
+		return
+	}
+	prefix, marker := r.URL.Query().Get("prefix"), r.URL.Query().Get("marker")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := f.pageSize > 0 && len(keys) > f.pageSize
+	if truncated {
+		keys = keys[:f.pageSize]
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<ListBucketResult><Prefix>%s</Prefix><Marker>%s</Marker><IsTruncated>%t</IsTruncated>", prefix, marker, truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(f.objects[key]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// adxLogLines 生成 n 行 ADX 请求，deviceId 为 prefix-序号
+func adxLogLines(prefix string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		line, _ := json.Marshal(AdxRequest{DeviceId: fmt.Sprintf("%s-%d", prefix, i), Ip: "1.2.3.4"})
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// testFetchConfig 测试中的重试间隔很短
+var testFetchConfig = FetchConfig{
+	Workers:      AdxDownloadWorkers,
+	Retries:      AdxRetries,
+	RetryBackoff: Duration(time.Millisecond),
+	MaxLineBytes: AdxMaxLineBytes,
+}
+
+func testAdxStream(t *testing.T) {
+	prefix := adxMinutePrefix("20261017", "10", "05")
+	objects := map[string]string{
+		prefix + "/a.log":                         adxLogLines("a", 3000),
+		prefix + "/b.log":                         adxLogLines("b", 2000) + "not json\n",
+		prefix + "/c.log":                         adxLogLines("c", 10),
+		"adx_device/request/20261017/10/06/d.log": adxLogLines("d", 5),
+	}
+	client := newFakeCos(t, objects, http.StatusOK)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	seen := make(map[string]bool)
+	stats, err := streamAdxRequests(context.Background(), logger, client, RegionSG, prefix, testFetchConfig, func(req AdxRequest) bool {
+		if seen[req.DeviceId] {
+			t.Errorf("重复收到 %s", req.DeviceId)
+		}
+		seen[req.DeviceId] = true
+		return true
+	})
+	if err != nil {
+		t.Fatalf("拉取失败: %v", err)
+	}
+	if len(seen) != 5010 || seen["d-0"] {
+		t.Errorf("应收到本分钟的 5010 条请求，实际 %d 条", len(seen))
+	}
+	if stats != (adxStreamStats{Objects: 3, Lines: 5011, InvalidJSON: 1}) {
+		t.Errorf("统计不正确: %+v", stats)
+	}
+
+	// 调用方提前停止时，下载的 goroutine 全部退出
+	before := runtime.NumGoroutine()
+	received := 0
+	if _, err := streamAdxRequests(context.Background(), logger, client, RegionSG, prefix, testFetchConfig, func(req AdxRequest) bool {
+		received++
+		return received < 5
+	}); err != nil {
+		t.Fatalf("拉取失败: %v", err)
+	}
+	if received != 5 {
+		t.Errorf("返回 false 后应停止，实际收到 %d 条", received)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("提前停止后仍有 %d 个 goroutine 未退出", n-before)
+	}
+
+	// 提前停止时列出下一页的请求被取消，不应报错
+	paged := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		paged[fmt.Sprintf("%s/part-%02d.log", prefix, i)] = adxLogLines(fmt.Sprintf("p%d", i), 5)
+	}
+	pagedClient := (&fakeCos{objects: paged, listStatus: http.StatusOK, pageSize: 2}).client(t)
+	for i := 0; i < 20; i++ {
+		if _, err := streamAdxRequests(context.Background(), logger, pagedClient, RegionSG, prefix, testFetchConfig, func(AdxRequest) bool {
+			return false
+		}); err != nil {
+			t.Fatalf("提前停止不应返回错误: %v", err)
+		}
+	}
+
+	failing := newFakeCos(t, objects, http.StatusInternalServerError)
+	if _, err := streamAdxRequests(context.Background(), logger, failing, RegionSG, prefix, testFetchConfig, func(AdxRequest) bool { return true }); err == nil {
+		t.Error("列出对象失败时应返回错误")
+	}
+}
+
+func testAdxPagination(t *testing.T) {
+	prefix := adxMinutePrefix("20261017", "10", "05")
+	objects := map[string]string{"adx_device/request/20261017/10/06/x.log": adxLogLines("x", 5)}
+	for i := 0; i < 230; i++ {
+		key := fmt.Sprintf("%s/part-%03d.log", prefix, i)
+		objects[key] = adxLogLines(fmt.Sprintf("o%d", i), 20)
+	}
+	flaky, cut, broken := prefix+"/part-007.log", prefix+"/part-120.log", prefix+"/part-229.log"
+	// SDK 自己会对 5xx 重试 3 次，失败 4 次需要我们的重试才能成功
+	fake := &fakeCos{
+		objects:    objects,
+		listStatus: http.StatusOK,
+		listErrors: 3,
+		pageSize:   50,
+		failures:   map[string]int{flaky: 4, broken: 1000},
+		truncate:   map[string]int{cut: len(adxLogLines("o120", 7)) + 10}, // 第 8 行中间断开
+	}
+	client := fake.client(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, workers := range []int{1, 8} {
+		config := testFetchConfig
+		config.Workers = workers
+		fake.mu.Lock()
+		fake.pages, fake.downloads = 0, nil
+		fake.mu.Unlock()
+
+		seen := make(map[string]int)
+		stats, err := streamAdxRequests(context.Background(), logger, client, RegionSG, prefix, config, func(req AdxRequest) bool {
+			seen[req.DeviceId]++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("workers=%d: 拉取失败: %v", workers, err)
+		}
+		if stats.Objects != 230 || stats.Failed != 1 || stats.Lines != 229*20 {
+			t.Errorf("workers=%d: 统计不正确: %+v", workers, stats)
+		}
+		if len(seen) != 229*20 {
+			t.Errorf("workers=%d: 应收到 %d 条请求，实际 %d 条", workers, 229*20, len(seen))
+		}
+		for i := 0; i < 229; i++ {
+			for j := 0; j < 20; j++ {
+				if id := fmt.Sprintf("o%d-%d", i, j); seen[id] != 1 {
+					t.Fatalf("workers=%d: %s 收到 %d 次", workers, id, seen[id])
+				}
+			}
+		}
+
+		fake.mu.Lock()
+		// 5 页，第一页先失败 3 次
+		if fake.pages != 5+3 {
+			t.Errorf("workers=%d: 列出对象 %d 次，应为 8 次", workers, fake.pages)
+		}
+		if fake.downloads[flaky] != 5 || fake.downloads[cut] != 2 || fake.downloads[broken] != 3*(AdxRetries+1) {
+			t.Errorf("workers=%d: 下载次数不正确: flaky=%d cut=%d broken=%d",
+				workers, fake.downloads[flaky], fake.downloads[cut], fake.downloads[broken])
+		}
+		fake.mu.Unlock()
+	}
+
+	// 取消时不再重试
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := streamAdxRequests(ctx, logger, client, RegionSG, prefix, FetchConfig{Workers: 1, Retries: 5, RetryBackoff: Duration(time.Hour)},
+		func(AdxRequest) bool { return true }); err == nil {
+		t.Error("取消后应返回错误")
+	}
+}
+
+// compressAdx 用指定格式压缩 data
+func compressAdx(t *testing.T, format adxCompression, data string) string {
+	var b bytes.Buffer
+	switch format {
+	case compressionGzip:
+		w := gzip.NewWriter(&b)
+		io.WriteString(w, data)
+		w.Close()
+	case compressionZstd:
+		w, err := zstd.NewWriter(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, data)
+		w.Close()
+	case compressionSnappy:
+		w := snappy.NewBufferedWriter(&b)
+		io.WriteString(w, data)
+		w.Close()
+	case compressionSnappyBlock:
+		b.Write(snappy.Encode(nil, []byte(data)))
+	default:
+		b.WriteString(data)
+	}
+	return b.String()
+}
+
+func testAdxCompression(t *testing.T) {
+	prefix := adxMinutePrefix("20261017", "10", "05")
+	longUA, _ := json.Marshal(AdxRequest{DeviceId: "long-ua", UserAgent: strings.Repeat("Mozilla/5.0 ", 20000)}) // 约 240KB
+	oversized := `{"device_id": "too-long", "user_agent": "` + strings.Repeat("x", 2<<20) + `"}`
+	objects := map[string]string{
+		prefix + "/a.log.gz":  compressAdx(t, compressionGzip, adxLogLines("gz", 300)),
+		prefix + "/b.log":     compressAdx(t, compressionZstd, adxLogLines("zst", 300)), // 没有扩展名，按魔数识别
+		prefix + "/c.snappy":  compressAdx(t, compressionSnappy, adxLogLines("snappy", 300)),
+		prefix + "/d.log.sz":  compressAdx(t, compressionSnappyBlock, adxLogLines("block", 300)),
+		prefix + "/e.log":     compressAdx(t, compressionGzip, adxLogLines("encoded", 300)),
+		prefix + "/f.log.zst": compressAdx(t, compressionZstd, adxLogLines("long", 10)+string(longUA)+"\nnot json\n"+oversized+"\n"+adxLogLines("tail", 10)),
+		prefix + "/g.log":     adxLogLines("plain", 300),
+	}
+	gz := compressAdx(t, compressionGzip, adxLogLines("cut", 2000))
+	objects[prefix+"/h.log.gz"] = gz
+	fake := &fakeCos{
+		objects:    objects,
+		listStatus: http.StatusOK,
+		encodings:  map[string]string{prefix + "/e.log": "gzip"},
+		truncate:   map[string]int{prefix + "/h.log.gz": len(gz) / 2},
+	}
+	client := fake.client(t)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	config := testFetchConfig
+	config.MaxLineBytes = 1 << 20
+	seen := make(map[string]int)
+	stats, err := streamAdxRequests(context.Background(), logger, client, RegionSG, prefix, config, func(req AdxRequest) bool {
+		seen[req.DeviceId]++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("拉取失败: %v", err)
+	}
+	for name, n := range map[string]int{"gz": 300, "zst": 300, "snappy": 300, "block": 300, "encoded": 300, "plain": 300,
+		"long": 10, "tail": 10, "cut": 2000} {
+		for i := 0; i < n; i++ {
+			if id := fmt.Sprintf("%s-%d", name, i); seen[id] != 1 {
+				t.Fatalf("%s 收到 %d 次", id, seen[id])
+			}
+		}
+	}
+	if seen["long-ua"] != 1 || seen["too-long"] != 0 {
+		t.Errorf("超过 64KB 的行应正常处理，超过上限的行应丢弃: long-ua=%d too-long=%d", seen["long-ua"], seen["too-long"])
+	}
+	want := adxStreamStats{Objects: 8, Lines: 6*300 + 10 + 3 + 10 + 2000, InvalidJSON: 1, Oversized: 1}
+	if stats != want {
+		t.Errorf("统计不正确: %+v，应为 %+v", stats, want)
+	}
+	if !regexp.MustCompile(`key=\S+/f\.log\.zst compression=zstd lines=23 invalid_json=1 oversized=1`).MatchString(logs.String()) {
+		t.Errorf("应按对象报告无法处理的行:\n%s", logs.String())
+	}
+
+	for _, c := range []struct {
+		key, encoding string
+		head          []byte
+		want          adxCompression
+	}{
+		{"x.log", "", []byte{0x1f, 0x8b, 8}, compressionGzip},
+		{"x.gz", "", []byte(`{"a":1}`), compressionNone}, // 已经被解压过
+		{"x.log", "snappy", []byte{0, 1}, compressionSnappyBlock},
+		{"x.SZ", "", []byte{0, 1}, compressionSnappyBlock},
+		{"x.log", "", []byte("\xff\x06\x00\x00sNaPpY"), compressionSnappy},
+		{"x.log", "", nil, compressionNone},
+	} {
+		if got := detectCompression(c.key, c.encoding, c.head); got != c.want {
+			t.Errorf("detectCompression(%q, %q) = %s，应为 %s", c.key, c.encoding, got, c.want)
+		}
+	}
+}
+
+func testCheckpoint(t *testing.T) {
+	path := t.TempDir() + "/watermark.json"
+	checkpoint, err := NewFetchCheckpoint(NewFileWatermarkStore(path), 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type call struct {
+		minute  string
+		regions []Region
+	}
+	var calls []call
+	failAt := map[Region]time.Time{} // 区域 -> 这一分钟拉取失败
+	process := func(minute time.Time, regions []Region) (done []Region) {
+		calls = append(calls, call{minute.Format("15:04"), regions})
+		for _, r := range regions {
+			if !failAt[r].Equal(minute) {
+				done = append(done, r)
+			}
+		}
+		return done
+	}
+	expect := func(want ...call) {
+		t.Helper()
+		if fmt.Sprint(calls) != fmt.Sprint(want) {
+			t.Errorf("处理顺序不正确:\n got %v\nwant %v", calls, want)
+		}
+		calls = nil
+	}
+	all := Regions
+
+	// 第一次启动只处理上一分钟，之后补齐错过的分钟
+	base := time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local)
+	if n := checkpoint.CatchUp(base, process); n != 1 {
+		t.Errorf("第一次应处理 1 分钟，实际 %d", n)
+	}
+	expect(call{"10:00", all})
+	checkpoint.CatchUp(base.Add(3*time.Minute), process)
+	expect(call{"10:01", all}, call{"10:02", all}, call{"10:03", all})
+	checkpoint.CatchUp(base.Add(3*time.Minute), process)
+	expect()
+
+	// 一个区域失败后不再处理它之后的分钟，其他区域继续；下次从失败的分钟重试
+	failAt[RegionSG] = base.Add(5 * time.Minute)
+	checkpoint.CatchUp(base.Add(7*time.Minute), process)
+	others := []Region{RegionDE, RegionUS}
+	expect(call{"10:04", all}, call{"10:05", all}, call{"10:06", others}, call{"10:07", others})
+	if lag := testutil.ToFloat64(fetchLag.WithLabelValues(string(RegionSG))); lag != 3 {
+		t.Errorf("sg 应落后 3 分钟，实际 %v", lag)
+	}
+	delete(failAt, RegionSG)
+	checkpoint.CatchUp(base.Add(8*time.Minute), process)
+	expect(call{"10:05", []Region{RegionSG}}, call{"10:06", []Region{RegionSG}}, call{"10:07", []Region{RegionSG}}, call{"10:08", all})
+	if lag := testutil.ToFloat64(fetchLag.WithLabelValues(string(RegionSG))); lag != 0 {
+		t.Errorf("补齐后 sg 不应落后，实际 %v", lag)
+	}
+
+	// 重启后从持久化的 watermark 继续
+	failAt[RegionUS] = base.Add(9 * time.Minute)
+	checkpoint.CatchUp(base.Add(9*time.Minute), process)
+	expect(call{"10:09", all})
+	restarted, err := NewFetchCheckpoint(NewFileWatermarkStore(path), 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wm := restarted.Watermarks(); !wm[RegionDE].Equal(base.Add(9*time.Minute)) || !wm[RegionUS].Equal(base.Add(8*time.Minute)) {
+		t.Errorf("重启后的 watermark 不正确: %v", wm)
+	}
+	delete(failAt, RegionUS)
+	restarted.CatchUp(base.Add(10*time.Minute), process)
+	expect(call{"10:09", []Region{RegionUS}}, call{"10:10", all})
+
+	// 落后太多时只补最近 maxCatchUp 内的分钟
+	skippedBefore := testutil.ToFloat64(fetchSkippedMinutes.WithLabelValues(string(RegionDE)))
+	if n := restarted.CatchUp(base.Add(5*time.Hour), process); n != 30 {
+		t.Errorf("应补齐 30 分钟，实际 %d", n)
+	}
+	if calls[0].minute != "14:31" || calls[29].minute != "15:00" {
+		t.Errorf("补齐范围不正确: %s - %s", calls[0].minute, calls[29].minute)
+	}
+	calls = nil
+	if got := testutil.ToFloat64(fetchSkippedMinutes.WithLabelValues(string(RegionDE))) - skippedBefore; got != 260 {
+		t.Errorf("应跳过 260 分钟，实际 %v", got)
+	}
+
+	if _, err := NewFetchCheckpoint(NewFileWatermarkStore(t.TempDir()+"/missing/watermark.json"), time.Hour); err != nil {
+		t.Errorf("没有 watermark 文件时应从头开始: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFetchCheckpoint(NewFileWatermarkStore(path), time.Hour); err == nil {
+		t.Error("watermark 文件损坏时应返回错误")
+	}
+
+	// 有对象下载失败时这一分钟不算完成，其余对象照常处理
+	minute := time.Date(2026, 10, 17, 10, 5, 0, 0, time.Local)
+	prefix := adxMinutePrefix("20261017", "10", "05")
+	fake := &fakeCos{
+		objects: map[string]string{
+			prefix + "/a.log": adxLogLines("a", 3),
+			prefix + "/b.log": adxLogLines("b", 3),
+		},
+		listStatus: http.StatusOK,
+		failures:   map[string]int{prefix + "/b.log": 1000},
+		failStatus: http.StatusInternalServerError,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	lines := 0
+	count := func(AdxRequest) bool { lines++; return true }
+	fetched, done := fetchRegionMinute(logger, fake.client(t), RegionUS, minute, testFetchConfig, count)
+	if done || fetched.Failed != 1 || lines != 3 {
+		t.Errorf("有对象失败时不应算完成: done=%v %+v lines=%d", done, fetched, lines)
+	}
+	delete(fake.failures, prefix+"/b.log")
+	lines = 0
+	if fetched, done := fetchRegionMinute(logger, fake.client(t), RegionUS, minute, testFetchConfig, count); !done || lines != 6 {
+		t.Errorf("全部下载成功时应算完成: done=%v %+v lines=%d", done, fetched, lines)
+	}
+	if _, done := fetchRegionMinute(logger, newFakeCos(t, fake.objects, http.StatusInternalServerError), RegionUS, minute, testFetchConfig, count); done {
+		t.Error("列出对象失败时不应算完成")
+	}
+
+	// 内容损坏的对象不重试，计入 Failed，但不阻塞这一分钟
+	gz := compressAdx(t, compressionGzip, adxLogLines("c", 100))
+	fake.objects[prefix+"/c.log.gz"] = gz[:len(gz)/2]
+	fake.objects[prefix+"/d.log"] = "\x00\x00\x00\x00"
+	fake.encodings = map[string]string{prefix + "/d.log": "snappy"}
+	fake.downloads = nil
+	lines = 0
+	fetched, done = fetchRegionMinute(logger, fake.client(t), RegionUS, minute, testFetchConfig, count)
+	if !done || fetched.Failed != 2 || fetched.Corrupt != 2 || lines < 6 {
+		t.Errorf("内容损坏的对象不应阻塞这一分钟: done=%v %+v lines=%d", done, fetched, lines)
+	}
+	if n := fake.downloads[prefix+"/c.log.gz"]; n != 1 {
+		t.Errorf("内容损坏的对象不应重试，实际下载 %d 次", n)
+	}
+
+	// 网络错误仍然阻塞
+	fake.failures = map[string]int{prefix + "/a.log": 1000}
+	fake.failStatus = 0
+	if fetched, done := fetchRegionMinute(logger, fake.client(t), RegionUS, minute, testFetchConfig, count); done || fetched.Corrupt != 2 {
+		t.Errorf("有对象下载失败时不应算完成: done=%v %+v", done, fetched)
+	}
+}
+
+func testBackfill(t *testing.T) {
+	args, err := parseBackfillArgs([]string{"--from", "2026-10-15T10:00", "--to", "2026-10-15T10:02", "--regions", "us,sg,us",
+		"--dry-run", "-config", "/etc/pando.json"}, io.Discard)
+	if err != nil {
+		t.Fatalf("解析参数失败: %v", err)
+	}
+	from := time.Date(2026, 10, 15, 10, 0, 0, 0, time.Local)
+	if !args.From.Equal(from) || !args.To.Equal(from.Add(2*time.Minute)) {
+		t.Errorf("时间范围不正确: %s - %s", args.From, args.To)
+	}
+	if fmt.Sprint(args.Regions) != "[us sg]" || args.Options != (minuteOptions{NoBloom: true, NoDDJ: true}) {
+		t.Errorf("区域或选项不正确: %v %+v", args.Regions, args.Options)
+	}
+	if fmt.Sprint(args.ConfigArgs) != "[-config /etc/pando.json]" {
+		t.Errorf("配置参数不正确: %v", args.ConfigArgs)
+	}
+
+	args, err = parseBackfillArgs([]string{"-from", "2026-10-15T10:00", "-no-ddj"}, io.Discard)
+	if err != nil {
+		t.Fatalf("解析参数失败: %v", err)
+	}
+	if !args.To.Equal(args.From) || len(args.Regions) != len(Regions) || args.Options != (minuteOptions{NoDDJ: true}) {
+		t.Errorf("默认值不正确: %+v", args)
+	}
+
+	// 只查询布隆过滤器但仍然发送时需要确认
+	args, err = parseBackfillArgs([]string{"-from", "2026-10-15T10:00", "-no-bloom", "-resend"}, io.Discard)
+	if err != nil || args.Options != (minuteOptions{NoBloom: true}) {
+		t.Errorf("-no-bloom -resend 应只查询布隆过滤器并发送: %+v %v", args.Options, err)
+	}
+
+	for _, bad := range [][]string{
+		nil,
+		{"-from", "2026-10-15 10:00"},
+		{"-from", "2026-10-15T10:00", "-to", "2026-10-15T09:59"},
+		{"-from", "2026-10-15T10:00", "-regions", "us,cn"},
+		{"-from", "2026-10-15T10:00", "extra"},
+		{"-from", "2026-10-15T10:00", "-no-bloom"},
+	} {
+		if _, err := parseBackfillArgs(bad, io.Discard); err == nil {
+			t.Errorf("参数 %q 应返回错误", bad)
+		}
+	}
+
+	// 逐分钟处理并打印统计，有区域没有完成时返回 1
+	args = backfillArgs{From: from, To: from.Add(2 * time.Minute), Regions: []Region{RegionUS, RegionSG}}
+	var minutes []string
+	var out bytes.Buffer
+	code := backfillMinutes(args, &out, func(minute time.Time) minuteStats {
+		minutes = append(minutes, minute.Format("15:04"))
+		stats := minuteStats{Done: args.Regions, Objects: 2, Lines: 100, Invalid: 1, Candidates: 50, Duplicates: 10, Allocated: 30, Sent: 30}
+		if minute.Minute() == 1 {
+			stats.Done = stats.Done[:1]
+		}
+		return stats
+	})
+	if code != 1 {
+		t.Errorf("有区域没有完成时应返回 1，实际 %d", code)
+	}
+	if fmt.Sprint(minutes) != "[10:00 10:01 10:02]" {
+		t.Errorf("处理的分钟不正确: %v", minutes)
+	}
+	for _, want := range []string{"2026-10-15 10:00  2/2", "2026-10-15 10:01  1/2 !", "合计", "6  300  3  150  30  90  90  0"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("输出缺少 %q:\n%s", want, out.String())
+		}
+	}
+
+	// 处理期间滑出窗口的数据单独列出，返回 1
+	out.Reset()
+	code = backfillMinutes(args, &out, func(minute time.Time) minuteStats {
+		stats := minuteStats{Done: args.Regions, Candidates: 5, Duplicates: 5}
+		if minute.Minute() == 0 {
+			stats.OutsideWindow = 5
+		}
+		return stats
+	})
+	if code != 1 || !strings.Contains(out.String(), "5 !") {
+		t.Errorf("有数据超出窗口时应返回 1 并标出: code=%d\n%s", code, out.String())
+	}
+
+	// 写入布隆过滤器时 -from 不能早于窗口内最早的桶，只读时不限制
+	windowConfig := testNamespaceConfig("backfill")
+	now := time.Date(2026, 10, 17, 10, 30, 0, 0, time.Local)
+	inWindow := backfillArgs{From: now.Add(-23 * time.Hour).Truncate(time.Hour)}
+	if err := checkBackfillWindow(inWindow, windowConfig, now); err != nil {
+		t.Errorf("窗口内的 -from 应允许: %v", err)
+	}
+	tooOld := backfillArgs{From: now.Add(-24 * time.Hour)}
+	if err := checkBackfillWindow(tooOld, windowConfig, now); err == nil {
+		t.Error("早于窗口的 -from 应拒绝")
+	}
+	tooOld.Options = minuteOptions{NoBloom: true, NoDDJ: true}
+	if err := checkBackfillWindow(tooOld, windowConfig, now); err != nil {
+		t.Errorf("只读时不限制 -from: %v", err)
+	}
+
+	// 服务运行时持有状态文件的锁，写入布隆过滤器的 backfill 被拒绝
+	dir := t.TempDir()
+	bloomConfig := DefaultConfig().Bloom
+	bloomConfig.StatePath = dir + "/bloom_state.bin"
+	bloomConfig.Capacity = 1000
+	bloomConfig.Shards = 1
+	store := NewLocalSnapshotStore(dir)
+	serviceLock, err := lockState(bloomConfig.StatePath)
+	if err != nil {
+		t.Fatalf("锁定状态文件失败: %v", err)
+	}
+	serviceConfig := bloomConfig.NamespaceConfig()
+	serviceConfig.WALSync = WALSyncAlways
+	service := newHourlyBloomManagerWithStore(serviceConfig, bloomConfig.StatePath, store)
+	service.Add("live_key")
+	if _, _, err := openBackfillManager(bloomConfig, store, false); !errors.Is(err, ErrStateLocked) {
+		t.Errorf("服务运行时应拒绝写入，实际: %v", err)
+	}
+
+	// 只读时可以和服务同时运行，能看到服务预写日志中的数据，不修改任何文件
+	walInfo, _ := os.Stat(walPath(bloomConfig.StatePath))
+	entries, _ := os.ReadDir(dir)
+	readOnly, release, err := openBackfillManager(bloomConfig, store, true)
+	if err != nil {
+		t.Fatalf("只读打开失败: %v", err)
+	}
+	if readOnly.wal != nil || !readOnly.Contains("live_key") {
+		t.Error("只读时不应打开预写日志，但应回放其中的数据")
+	}
+	release()
+	if info, _ := os.Stat(walPath(bloomConfig.StatePath)); info.Size() != walInfo.Size() {
+		t.Errorf("只读打开不应修改预写日志: %d -> %d", walInfo.Size(), info.Size())
+	}
+	if after, _ := os.ReadDir(dir); len(after) != len(entries) {
+		t.Errorf("只读打开不应创建文件: %d -> %d", len(entries), len(after))
+	}
+
+	// 服务停止后可以写入
+	service.Close()
+	serviceLock.Close()
+	manager, release, err := openBackfillManager(bloomConfig, store, false)
+	if err != nil {
+		t.Fatalf("服务停止后应可以写入: %v", err)
+	}
+	if !manager.Contains("live_key") || manager.wal == nil {
+		t.Error("写入时应回放并打开预写日志")
+	}
+	if _, err := lockState(bloomConfig.StatePath); !errors.Is(err, ErrStateLocked) {
+		t.Errorf("backfill 写入期间服务应无法启动，实际: %v", err)
+	}
+	release()
+}
+
+// benchmarkParallelDedup 多个 goroutine 并发调用 TestAndAdd 和 Contains，shards=1 即原来的单锁实现
+func benchmarkParallelDedup(b *testing.B, shards int) {
+	config := NamespaceConfig{
+		Name:          "bench",
+		Window:        Duration(24 * time.Hour),
+		Bucket:        Duration(time.Hour),
+		Capacity:      1_000_000,
+		FalsePositive: FalsePositive,
+		Shards:        shards,
+	}
+	manager := newHourlyBloomManager(config, b.TempDir()+"/state.bin")
+
+	var seq int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("bench_key_%d", atomic.AddInt64(&seq, 1))
+			manager.TestAndAdd(key)
+			manager.Contains(key)
+		}
+	})
+}
+
+func BenchmarkDedupSingleLock(b *testing.B) {
+	benchmarkParallelDedup(b, 1)
+}
+
+func BenchmarkDedupSharded(b *testing.B) {
+	benchmarkParallelDedup(b, DefaultShards)
 }
@@ -1,8 +1,57 @@
 #!/bin/bash
+# 重新编译并重启服务。配置文件由 PANDO_CONFIG 指定，默认 ./pando-bloom.json（参考 pando-bloom.example.json），
+# 也可以只用 PANDO_ 开头的环境变量提供密钥，见 Config.go。新配置校验通过后才停止正在运行的实例。
+# 服务的 PID 记在 PIDFILE 中，只停止服务本身，不影响同时运行的 backfill 等子命令；
+# 停止后等待旧进程保存完快照、释放状态文件的锁再启动新进程
+set -e
+
+CONFIG=${PANDO_CONFIG:-./pando-bloom.json}
+PIDFILE=${PANDO_PIDFILE:-./pando-bloom.pid}
+STOP_TIMEOUT=${PANDO_STOP_TIMEOUT:-600} # 等待旧进程退出的最长秒数
 
 go build
 
-killall pando-bloom
+if [ -f "$CONFIG" ]; then
+    ./pando-bloom check-config -config "$CONFIG"
+else
+    echo "配置文件 $CONFIG 不存在，只使用默认值和 PANDO_ 环境变量" >&2
+    ./pando-bloom check-config
+fi
+
+# servicePids 正在运行的服务进程：优先用 PIDFILE，没有或已失效时（如第一次用本脚本部署）按命令行找，排除子命令
+servicePids() {
+    if [ -f "$PIDFILE" ]; then
+        pid=$(cat "$PIDFILE")
+        if kill -0 "$pid" 2>/dev/null && [ "$(ps -p "$pid" -o comm=)" = "pando-bloom" ]; then
+            echo "$pid"
+            return
+        fi
+    fi
+    for pid in $(pgrep -x pando-bloom || true); do
+        if ! tr '\0' ' ' < "/proc/$pid/cmdline" | grep -Eq ' (backfill|inspect|check-config)( |$)'; then
+            echo "$pid"
+        fi
+    done
+}
+
+for pid in $(servicePids); do
+    echo "停止服务 $pid"
+    kill -TERM "$pid"
+    waited=0
+    while kill -0 "$pid" 2>/dev/null; do
+        if [ "$waited" -ge "$STOP_TIMEOUT" ]; then
+            echo "服务 $pid ${STOP_TIMEOUT}s 内没有退出，不启动新进程" >&2
+            exit 1
+        fi
+        sleep 1
+        waited=$((waited + 1))
+    done
+    echo "服务 $pid 已退出，用时 ${waited}s"
+done
 
-sleep  10
-nohup ./pando-bloom 2>&1 &
\ No newline at end of file
+if [ -f "$CONFIG" ]; then
+    nohup ./pando-bloom -config "$CONFIG" 2>&1 &
+else
+    nohup ./pando-bloom 2>&1 &
+fi
+echo $! > "$PIDFILE"